@@ -100,7 +100,7 @@ async function handleInfra(args: string[]): Promise<void> {
 
 async function handleDeploy(args: string[]): Promise<void> {
   const opts = parseFlags(args, {
-    string: ["name", "server"],
+    string: ["name", "server", "ttl"],
     number: ["size", "version"],
     boolean: ["json"]
   });
@@ -113,6 +113,7 @@ async function handleDeploy(args: string[]): Promise<void> {
   if (opts.strings.name) body.name = opts.strings.name;
   if (opts.numbers.size !== undefined) body.size_gb = opts.numbers.size;
   if (opts.numbers.version !== undefined) body.version = opts.numbers.version;
+  if (opts.strings.ttl) body.ttl = opts.strings.ttl;
 
   const result = await apiRequest<DeployResponse>({
     baseUrl: url,
@@ -279,6 +280,10 @@ function validateUrl(value: string): void {
 
 function formatError(error: unknown): string {
   if (error instanceof HttpError) {
+    const apiError = error.body as { code?: string; message?: string; request_id?: string } | undefined;
+    if (apiError && typeof apiError === "object" && apiError.message) {
+      return `${error.message}: ${apiError.message} (${apiError.code}, request ${apiError.request_id})`;
+    }
     const body =
       typeof error.body === "string"
         ? error.body
@@ -295,7 +300,7 @@ function formatError(error: unknown): string {
 
 function printHelp(): void {
   console.log(`pgdb commands:
-  pgdb deploy [--name <string>] [--size <gb>] [--version <major>] [--server <alias>] [--json]
+  pgdb deploy [--name <string>] [--size <gb>] [--version <major>] [--ttl <duration>] [--server <alias>] [--json]
   pgdb status [--server <alias>] [--json]
   pgdb destroy <name> [--keep-data] [--server <alias>] [--json]
   pgdb config set server.default <url>
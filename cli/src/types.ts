@@ -2,6 +2,7 @@ export type DeployRequest = {
   name?: string;
   size_gb?: number;
   version?: number;
+  ttl?: string;
 };
 
 export type DeployResponse = {
@@ -14,6 +15,7 @@ export type DeployResponse = {
   database_url: string;
   created_at: string;
   postgres_version: string;
+  expires_at?: string;
 };
 
 export type StatusItem = {
@@ -28,6 +30,7 @@ export type StatusItem = {
   created_at: string;
   postgres_version: string;
   database_url: string;
+  expires_at?: string;
 };
 
 export type StatusResponse = {
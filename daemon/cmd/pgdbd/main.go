@@ -1,18 +1,35 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"pgdb/daemon/internal/api"
+	"pgdb/daemon/internal/audit"
+	"pgdb/daemon/internal/config"
 	"pgdb/daemon/internal/core"
 	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/events"
 	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/systemd"
+	"pgdb/daemon/internal/tracing"
+	"pgdb/daemon/internal/webhooks"
 )
 
+// shutdownTimeout bounds how long a stopping daemon waits for requests
+// still running, such as a deploy pulling an image.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
 
@@ -20,6 +37,9 @@ func main() {
 	dataDir := envOrDefault("PGDB_DATA_DIR", "/var/lib/pgdb")
 	publicHost := envOrDefault("PGDB_PUBLIC_HOST", "")
 	token := os.Getenv("PGDB_TOKEN")
+	metricsToken := envOrDefault("PGDB_METRICS_TOKEN", token)
+	imageUpdateInterval := os.Getenv("PGDB_IMAGE_UPDATE_INTERVAL")
+	defaultWindow := strings.ToLower(strings.TrimSpace(os.Getenv("PGDB_MAINTENANCE_WINDOW")))
 
 	if token == "" {
 		logger.Error("PGDB_TOKEN is required")
@@ -31,47 +51,366 @@ func main() {
 		os.Exit(1)
 	}
 
+	configPath := envOrDefault("PGDB_CONFIG", filepath.Join(dataDir, "config.json"))
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		logger.Error("failed to load config", "path", configPath, "error", err)
+		os.Exit(1)
+	}
+
 	registryPath := filepath.Join(dataDir, "registry.json")
 	lockPath := filepath.Join(dataDir, "registry.lock")
 
+	eventLog, err := events.Open(filepath.Join(dataDir, "events.jsonl"), logger)
+	if err != nil {
+		logger.Error("failed to open event log", "error", err)
+		os.Exit(1)
+	}
+
+	auditKey, err := loadAuditKey(os.Getenv("PGDB_AUDIT_KEY_FILE"), dataDir)
+	if err != nil {
+		logger.Error("failed to load audit key", "error", err)
+		os.Exit(1)
+	}
+	if auditKey == nil {
+		logger.Warn("PGDB_AUDIT_KEY_FILE is not set; the audit log chain is not keyed and a rewrite of the whole file goes unnoticed")
+	}
+	auditLog, err := audit.Open(filepath.Join(dataDir, "audit.jsonl"), auditKey)
+	if err != nil {
+		logger.Error("failed to open audit log", "error", err)
+		os.Exit(1)
+	}
+
+	tracesExporter := envOrDefault("PGDB_TRACES_EXPORTER", "none")
+	stopTracing, err := configureTracing(tracesExporter, dataDir, logger)
+	if err != nil {
+		logger.Error("failed to configure tracing", "exporter", tracesExporter, "error", err)
+		os.Exit(1)
+	}
+
 	dockerClient := docker.NewClient()
 	if err := dockerClient.EnsureAvailable(); err != nil {
 		logger.Error("docker is not ready", "error", err)
 		os.Exit(1)
 	}
 
+	updater := &core.Updater{
+		RegistryPath: registryPath,
+		LockPath:     lockPath,
+		Docker:       dockerClient,
+		Config:       &cfg,
+		Logger:       logger,
+		Events:       eventLog,
+
+		DefaultWindow: defaultWindow,
+	}
+	if err := core.CheckMaintenanceWindow(defaultWindow); err != nil {
+		logger.Error("PGDB_MAINTENANCE_WINDOW is invalid", "value", defaultWindow, "error", err)
+		os.Exit(1)
+	}
+	if imageUpdateInterval != "" {
+		interval, err := time.ParseDuration(imageUpdateInterval)
+		if err != nil || interval <= 0 {
+			logger.Error("PGDB_IMAGE_UPDATE_INTERVAL must be a positive duration", "value", imageUpdateInterval)
+			os.Exit(1)
+		}
+		go updater.Run(context.Background(), interval)
+	}
+
+	credentials := &core.CredentialService{
+		RegistryPath: registryPath,
+		LockPath:     lockPath,
+		Docker:       dockerClient,
+		Logger:       logger,
+	}
+	go credentials.Run(context.Background(), time.Minute)
+
+	destroyer := &core.Destroyer{
+		RegistryPath: registryPath,
+		LockPath:     lockPath,
+		Docker:       dockerClient,
+		Events:       eventLog,
+	}
+	leases := &core.LeaseService{
+		RegistryPath: registryPath,
+		LockPath:     lockPath,
+		Destroyer:    destroyer,
+		Logger:       logger,
+	}
+	go leases.Run(context.Background(), time.Minute)
+
+	deployer := &core.Deployer{
+		RegistryPath: registryPath,
+		LockPath:     lockPath,
+		PublicHost:   publicHost,
+		Docker:       dockerClient,
+		Config:       &cfg,
+		Events:       eventLog,
+	}
+	pool := &core.Pool{
+		RegistryPath: registryPath,
+		LockPath:     lockPath,
+		Deployer:     deployer,
+		Logger:       logger,
+	}
+	go pool.Run(context.Background(), 10*time.Second)
+
+	monitor := &core.Monitor{
+		RegistryPath:  registryPath,
+		LockPath:      lockPath,
+		Docker:        dockerClient,
+		Events:        eventLog,
+		Logger:        logger,
+		DiskThreshold: cfg.Monitor.DiskThresholdPercent,
+	}
+	go monitor.Run(context.Background(), 30*time.Second)
+
+	metricsCollector := &core.MetricsCollector{
+		RegistryPath: registryPath,
+		LockPath:     lockPath,
+		Docker:       dockerClient,
+		Logger:       logger,
+	}
+	go metricsCollector.Run(context.Background(), 15*time.Second)
+
+	dispatcher := &webhooks.Dispatcher{
+		StatePath: filepath.Join(dataDir, "webhooks.json"),
+		Webhooks:  cfg.Webhooks,
+		Events:    eventLog,
+		Logger:    logger,
+		Client:    &http.Client{},
+	}
+	if err := dispatcher.Load(); err != nil {
+		logger.Error("failed to load webhook queue", "error", err)
+		os.Exit(1)
+	}
+	go dispatcher.Run(context.Background(), 2*time.Second)
+
 	handlers := &api.Handlers{
-		Logger: logger,
-		Deployer: &core.Deployer{
+		Logger:   logger,
+		Deployer: deployer,
+		StatusSvc: &core.StatusService{
+			RegistryPath: registryPath,
+			LockPath:     lockPath,
+		},
+		Destroyer: destroyer,
+		Cloner: &core.Cloner{
 			RegistryPath: registryPath,
 			LockPath:     lockPath,
-			PublicHost:   publicHost,
+			Deployer:     deployer,
 			Docker:       dockerClient,
 		},
-		StatusSvc: &core.StatusService{
+		MaskingSvc: &core.MaskingService{
 			RegistryPath: registryPath,
 			LockPath:     lockPath,
+			Docker:       dockerClient,
 		},
-		Destroyer: &core.Destroyer{
+		Upgrader: &core.Upgrader{
 			RegistryPath: registryPath,
 			LockPath:     lockPath,
 			Docker:       dockerClient,
+			Config:       &cfg,
+		},
+		Updater: updater,
+		Extensions: &core.ExtensionService{
+			RegistryPath: registryPath,
+			LockPath:     lockPath,
+			Docker:       dockerClient,
+		},
+		Parameters: &core.ParameterService{
+			RegistryPath: registryPath,
+			LockPath:     lockPath,
+			Docker:       dockerClient,
+			Events:       eventLog,
+		},
+		Admin: &core.AdminMigrator{
+			RegistryPath: registryPath,
+			LockPath:     lockPath,
+			Docker:       dockerClient,
+		},
+		Roles: &core.RoleService{
+			RegistryPath: registryPath,
+			LockPath:     lockPath,
+			Docker:       dockerClient,
+		},
+		Credentials: credentials,
+		Leases:      leases,
+		Snapshots: &core.SnapshotService{
+			RegistryPath: registryPath,
+			LockPath:     lockPath,
+			Docker:       dockerClient,
+		},
+		Databases: &core.DatabaseService{
+			RegistryPath: registryPath,
+			LockPath:     lockPath,
+			Docker:       dockerClient,
+		},
+		Metrics: metricsCollector,
+		Queries: &core.QueryStatsService{
+			RegistryPath: registryPath,
+			LockPath:     lockPath,
+			Docker:       dockerClient,
+		},
+		Activity: &core.ActivityService{
+			RegistryPath: registryPath,
+			LockPath:     lockPath,
+			Docker:       dockerClient,
+		},
+		Logs: &core.LogService{
+			RegistryPath: registryPath,
+			LockPath:     lockPath,
+			Docker:       dockerClient,
+		},
+		Events:   eventLog,
+		Webhooks: dispatcher,
+		Audit:    auditLog,
+		Health: &core.HealthChecker{
+			DataDir:      dataDir,
+			RegistryPath: registryPath,
+			Docker:       dockerClient,
 		},
 	}
 
 	mux := http.NewServeMux()
-	handlers.Register(mux, token)
+	handlers.Register(mux, token, metricsToken)
 
 	server := &http.Server{
 		Addr:    listen,
 		Handler: mux,
 	}
 
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "server error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := systemd.Notify("READY=1"); err != nil {
+		logger.Warn("sd_notify failed", "error", err)
+	}
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		go systemd.RunWatchdog(interval, func() bool { return probeHealthz(listener.Addr()) })
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		logger.Info("pgdbd stopping")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("requests still running at shutdown", "error", err)
+		}
+	}()
+
 	logger.Info("pgdbd started", "listen", listen, "data_dir", dataDir)
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		fmt.Fprintf(os.Stderr, "server error: %v\n", err)
 		os.Exit(1)
 	}
+	// Serve returns as soon as Shutdown starts; wait for the requests still
+	// running so their spans are exported too.
+	<-stopped
+	stopTracing()
+	logger.Info("pgdbd stopped")
+}
+
+// loadAuditKey reads the audit HMAC key from path. The key must live
+// outside the data directory: whoever can rewrite the audit log there
+// must not be able to read it.
+func loadAuditKey(path, dataDir string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dataAbs, err := filepath.Abs(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(dataAbs, abs); err == nil && !strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("PGDB_AUDIT_KEY_FILE %s must be outside the data directory %s", path, dataDir)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(strings.TrimSpace(string(b)))
+	if len(key) < 32 {
+		return nil, fmt.Errorf("PGDB_AUDIT_KEY_FILE %s must hold at least 32 characters", path)
+	}
+	return key, nil
+}
+
+// configureTracing installs the span exporter named by PGDB_TRACES_EXPORTER:
+// "otlp" posts to a collector configured with the standard OTEL_ variables,
+// "stdout" and "file" write JSON lines, "none" drops spans. The returned
+// function exports the spans still queued and must be called on shutdown.
+func configureTracing(exporter, dataDir string, logger *slog.Logger) (func(), error) {
+	switch exporter {
+	case "none":
+		return func() {}, nil
+	case "stdout":
+		tracing.SetExporter(tracing.NewJSONExporter(os.Stdout))
+	case "file":
+		path := envOrDefault("PGDB_TRACES_FILE", filepath.Join(dataDir, "traces.jsonl"))
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		tracing.SetExporter(tracing.NewJSONExporter(f))
+	case "otlp":
+		url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+		if url == "" {
+			url = strings.TrimSuffix(envOrDefault("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"), "/") + "/v1/traces"
+		}
+		headers := map[string]string{}
+		for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+			if k, v, ok := strings.Cut(pair, "="); ok {
+				headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+		batcher := &tracing.Batcher{
+			Exporter: &tracing.OTLPExporter{
+				URL:         url,
+				Headers:     headers,
+				ServiceName: envOrDefault("OTEL_SERVICE_NAME", "pgdbd"),
+				Client:      &http.Client{Timeout: 10 * time.Second},
+			},
+			Logger: logger,
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			batcher.Run(ctx, 2*time.Second)
+			close(done)
+		}()
+		tracing.SetExporter(batcher)
+		return func() {
+			cancel()
+			<-done
+		}, nil
+	default:
+		return nil, fmt.Errorf("PGDB_TRACES_EXPORTER must be none, otlp, stdout or file")
+	}
+	return func() {}, nil
+}
+
+// probeHealthz calls the daemon's own /healthz, so the watchdog is only fed
+// while the server still answers requests.
+func probeHealthz(addr net.Addr) bool {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + addr.String() + "/healthz")
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
 }
 
 func envOrDefault(key, fallback string) string {
@@ -1,107 +1,927 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
+	"pgdb/daemon/internal/audit"
 	"pgdb/daemon/internal/core"
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/events"
 	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/tracing"
+	"pgdb/daemon/internal/webhooks"
 )
 
 var versionRe = regexp.MustCompile(`^\d+$`)
 
 type Handlers struct {
-	Logger    *slog.Logger
-	Deployer  *core.Deployer
-	StatusSvc *core.StatusService
-	Destroyer *core.Destroyer
+	Logger      *slog.Logger
+	Deployer    *core.Deployer
+	StatusSvc   *core.StatusService
+	Destroyer   *core.Destroyer
+	Cloner      *core.Cloner
+	MaskingSvc  *core.MaskingService
+	Upgrader    *core.Upgrader
+	Updater     *core.Updater
+	Extensions  *core.ExtensionService
+	Parameters  *core.ParameterService
+	Admin       *core.AdminMigrator
+	Roles       *core.RoleService
+	Credentials *core.CredentialService
+	Databases   *core.DatabaseService
+	Leases      *core.LeaseService
+	Snapshots   *core.SnapshotService
+	Metrics     *core.MetricsCollector
+	Health      *core.HealthChecker
+	Queries     *core.QueryStatsService
+	Activity    *core.ActivityService
+	Logs        *core.LogService
+	Events      *events.Log
+	Webhooks    *webhooks.Dispatcher
+	Audit       *audit.Log
 }
 
-func (h *Handlers) Register(mux *http.ServeMux, token string) {
+// Register mounts the API. /metrics is checked against metricsToken so
+// scrapers do not need the admin token; /healthz and /readyz are open so
+// load balancers and probes can call them.
+func (h *Handlers) Register(mux *http.ServeMux, token, metricsToken string) {
 	secured := AuthMiddleware(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, rest, isDB := splitDBPath(r.URL.Path)
+		hook, hookRest, isHook := splitPath(r.URL.Path, "/v1/webhooks/")
 		switch {
 		case r.Method == http.MethodPost && r.URL.Path == "/v1/deploy":
 			h.handleDeploy(w, r)
 		case r.Method == http.MethodGet && r.URL.Path == "/v1/status":
 			h.handleStatus(w, r)
-		case r.Method == http.MethodDelete && matchesDBDeletePath(r.URL.Path):
-			h.handleDestroy(w, r)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/events":
+			h.handleEvents(w, r)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/audit":
+			h.handleAudit(w, r)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/webhooks":
+			writeJSON(w, http.StatusOK, h.Webhooks.List())
+		case r.Method == http.MethodGet && isHook && matchRest(hookRest, "deliveries"):
+			h.handleWebhookDeliveries(w, r, hook)
+		case r.Method == http.MethodPost && isHook && matchRest(hookRest, "test"):
+			h.handleTestWebhook(w, r, hook)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/versions":
+			writeJSON(w, http.StatusOK, h.Deployer.Versions())
+		case r.Method == http.MethodDelete && isDB && matchRest(rest):
+			h.handleDestroy(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "lease"):
+			h.handleRenewLease(w, r, name)
+		case r.Method == http.MethodGet && isDB && matchRest(rest, "snapshots"):
+			h.handleListSnapshots(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "snapshots"):
+			h.handleCreateSnapshot(w, r, name)
+		case r.Method == http.MethodDelete && isDB && matchRest(rest, "snapshots", "*"):
+			h.handleDeleteSnapshot(w, r, name, rest[1])
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "reset"):
+			h.handleReset(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "clone"):
+			h.handleClone(w, r, name)
+		case r.Method == http.MethodGet && isDB && matchRest(rest, "masking"):
+			h.handleGetMasking(w, r, name)
+		case r.Method == http.MethodPut && isDB && matchRest(rest, "masking"):
+			h.handleSetMasking(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "upgrade"):
+			h.handleUpgrade(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "upgrade", "confirm"):
+			h.handleUpgradeResult(w, r, name, h.Upgrader.Confirm)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "upgrade", "rollback"):
+			h.handleUpgradeResult(w, r, name, h.Upgrader.Rollback)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "update-image"):
+			h.handleUpdateImage(w, r, name)
+		case r.Method == http.MethodPut && isDB && matchRest(rest, "maintenance-window"):
+			h.handleSetMaintenanceWindow(w, r, name)
+		case r.Method == http.MethodGet && isDB && matchRest(rest, "extensions"):
+			h.handleListExtensions(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "extensions"):
+			h.handleCreateExtension(w, r, name)
+		case r.Method == http.MethodGet && isDB && matchRest(rest, "parameters"):
+			h.handleGetParameters(w, r, name)
+		case r.Method == http.MethodPatch && isDB && matchRest(rest, "parameters"):
+			h.handlePatchParameters(w, r, name)
+		case r.Method == http.MethodGet && isDB && matchRest(rest, "queries"):
+			h.handleListQueries(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "queries", "reset"):
+			h.handleResetQueries(w, r, name)
+		case r.Method == http.MethodGet && isDB && matchRest(rest, "activity"):
+			h.handleListActivity(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "activity", "*", "cancel"):
+			h.handleSignalSession(w, r, name, rest[1], "cancel", h.Activity.Cancel)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "activity", "*", "terminate"):
+			h.handleSignalSession(w, r, name, rest[1], "terminate", h.Activity.Terminate)
+		case r.Method == http.MethodGet && isDB && matchRest(rest, "logs"):
+			h.handleLogs(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "migrate-roles"):
+			h.handleMigrateRoles(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "rotate-credentials"):
+			h.handleRotateCredentials(w, r, name)
+		case r.Method == http.MethodGet && isDB && matchRest(rest, "credentials"):
+			h.handleListCredentials(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "credentials"):
+			h.handleIssueCredential(w, r, name)
+		case r.Method == http.MethodGet && isDB && matchRest(rest, "databases"):
+			h.handleListDatabases(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "databases"):
+			h.handleCreateDatabase(w, r, name)
+		case r.Method == http.MethodDelete && isDB && matchRest(rest, "databases", "*"):
+			h.handleDropDatabase(w, r, name, rest[1])
+		case r.Method == http.MethodGet && isDB && matchRest(rest, "roles"):
+			h.handleListRoles(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "roles"):
+			h.handleCreateRole(w, r, name)
+		case r.Method == http.MethodPost && isDB && matchRest(rest, "roles", "*", "rotate"):
+			h.handleRotateRole(w, r, name, rest[1])
+		case r.Method == http.MethodDelete && isDB && matchRest(rest, "roles", "*"):
+			h.handleDropRole(w, r, name, rest[1])
 		default:
-			writeJSON(w, http.StatusNotFound, map[string]any{"error": "not found"})
+			writeError(w, r, http.StatusNotFound, core.CodeNotFound, "not found", nil)
 		}
 	}))
 
-	mux.Handle("/", secured)
+	// Every route gets a request ID first, so access logs, handler logs,
+	// audit records, error bodies and the request's span all carry it.
+	wrap := func(next http.Handler) http.Handler {
+		return RequestIDMiddleware(TracingMiddleware(AccessLogMiddleware(h.Logger, MetricsMiddleware(next))))
+	}
+	mux.Handle("/", wrap(AuditMiddleware(h.Audit, token, h.Logger, secured)))
+	mux.Handle("/metrics", wrap(AuthMiddleware(metricsToken, http.HandlerFunc(h.handleMetrics))))
+	mux.Handle("/healthz", wrap(http.HandlerFunc(h.handleHealthz)))
+	mux.Handle("/readyz", wrap(http.HandlerFunc(h.handleReadyz)))
+}
+
+// log returns the handler logger with the request and trace IDs attached.
+func (h *Handlers) log(r *http.Request) *slog.Logger {
+	return h.Logger.With("request_id", RequestID(r.Context()), "trace_id", tracing.FromContext(r.Context()).TraceID())
+}
+
+func (h *Handlers) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, model.HealthResponse{
+		Status: "ok",
+		Checks: []model.HealthCheck{{Name: "process", OK: true}},
+	})
+}
+
+func (h *Handlers) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := h.Health.Ready()
+	if resp.Status != "ok" {
+		h.log(r).Warn("readiness check failed", "checks", resp.Checks)
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.Metrics.Write(w)
 }
 
 func (h *Handlers) handleDeploy(w http.ResponseWriter, r *http.Request) {
 	var req model.DeployRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, http.ErrBodyReadAfterClose) {
-		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid json body"})
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
 		return
 	}
 
 	if req.Version != 0 && !versionRe.MatchString(strconv.Itoa(req.Version)) {
-		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "version must be a major integer"})
+		writeInvalid(w, r, "version", "version must be a major integer")
 		return
 	}
 
-	resp, err := h.Deployer.Deploy(req, r.Host)
+	resp, err := h.Deployer.Deploy(r.Context(), req, r.Host)
 	if err != nil {
-		h.Logger.Error("deploy failed", "error", err)
-		writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+		h.log(r).Error("deploy failed", "error", err)
+		writeFailure(w, r, err)
 		return
 	}
 
 	writeJSON(w, http.StatusOK, resp)
 }
 
-func (h *Handlers) handleStatus(w http.ResponseWriter, _ *http.Request) {
-	resp, err := h.StatusSvc.Status()
+func (h *Handlers) handleStatus(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.StatusSvc.Status(r.Context())
+	if err != nil {
+		h.log(r).Error("status failed", "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// eventsKeepalive is how often an idle event stream gets a comment line, so
+// proxies do not close it.
+const eventsKeepalive = 15 * time.Second
+
+// handleEvents streams lifecycle events as server-sent events. Clients
+// resume with the Last-Event-ID header, or the last_event_id parameter,
+// and get the retained events after that ID before live ones.
+func (h *Handlers) handleEvents(w http.ResponseWriter, r *http.Request) {
+	lastID := int64(-1)
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("last_event_id")
+	}
+	if raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id < 0 {
+			writeInvalid(w, r, "last_event_id", "last event id must be a non-negative number")
+			return
+		}
+		lastID = id
+	}
+	name := r.URL.Query().Get("name")
+
+	// Subscribe before reading the backlog so no event falls in between.
+	live, unsubscribe := h.Events.Subscribe()
+	defer unsubscribe()
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e events.Event) error {
+		if name != "" && e.Name != name {
+			return nil
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+		return err
+	}
+	// replay sends the retained events after lastID; without a last ID
+	// the stream starts with live events only.
+	replay := func() error {
+		if lastID < 0 {
+			return nil
+		}
+		for _, e := range h.Events.Since(lastID) {
+			if err := send(e); err != nil {
+				return err
+			}
+			lastID = e.ID
+		}
+		return nil
+	}
+
+	if err := replay(); err != nil {
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	keepalive := time.NewTicker(eventsKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e := <-live:
+			switch {
+			case lastID >= 0 && e.ID <= lastID:
+				continue
+			case lastID >= 0 && e.ID > lastID+1:
+				// Live events were dropped while this client was slow.
+				if err := replay(); err != nil {
+					return
+				}
+			default:
+				if err := send(e); err != nil {
+					return
+				}
+				lastID = e.ID
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+func (h *Handlers) handleAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := audit.Filter{Database: q.Get("name"), Limit: defaultAuditLimit}
+	for _, p := range []struct {
+		key string
+		dst *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		raw := q.Get(p.key)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			writeInvalid(w, r, p.key, p.key+" must be an RFC3339 time")
+			return
+		}
+		*p.dst = t
+	}
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			writeInvalid(w, r, "limit", fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit))
+			return
+		}
+		filter.Limit = n
+	}
+
+	items, chain, err := h.Audit.Query(filter)
+	if err != nil {
+		h.log(r).Error("audit query failed", "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+	if !chain.Valid {
+		h.log(r).Error("audit log chain is broken", "seq", chain.BrokenAt, "error", chain.Error)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"items": items, "chain": chain})
+}
+
+func (h *Handlers) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.Webhooks.Deliveries(name)
 	if err != nil {
-		h.Logger.Error("status failed", "error", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		writeError(w, r, http.StatusNotFound, core.CodeNotFound, err.Error(), map[string]any{"webhook": name})
 		return
 	}
 
 	writeJSON(w, http.StatusOK, resp)
 }
 
-func (h *Handlers) handleDestroy(w http.ResponseWriter, r *http.Request) {
-	name, err := parseNameFromPath(r.URL.Path)
+func (h *Handlers) handleTestWebhook(w http.ResponseWriter, r *http.Request, name string) {
+	attempt, err := h.Webhooks.Test(name)
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+		writeError(w, r, http.StatusNotFound, core.CodeNotFound, err.Error(), map[string]any{"webhook": name})
 		return
 	}
+	if attempt.Error != "" {
+		h.log(r).Warn("webhook test failed", "webhook", name, "error", attempt.Error)
+	}
 
+	writeJSON(w, http.StatusOK, attempt)
+}
+
+func (h *Handlers) handleDestroy(w http.ResponseWriter, r *http.Request, name string) {
 	keepData := r.URL.Query().Get("keep_data") == "true"
-	if err := h.Destroyer.Destroy(name, keepData); err != nil {
-		h.Logger.Error("destroy failed", "name", name, "error", err)
-		writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+	if err := h.Destroyer.Destroy(r.Context(), name, keepData); err != nil {
+		h.log(r).Error("destroy failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (h *Handlers) handleRenewLease(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.LeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.Leases.Renew(r.Context(), name, req)
+	if err != nil {
+		h.log(r).Error("renew lease failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleListSnapshots(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.Snapshots.List(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("list snapshots failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleCreateSnapshot(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.CreateSnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.Snapshots.Create(r.Context(), name, req)
+	if err != nil {
+		h.log(r).Error("create snapshot failed", "name", name, "snapshot", req.Name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleDeleteSnapshot(w http.ResponseWriter, r *http.Request, name, snapshot string) {
+	if err := h.Snapshots.Delete(r.Context(), name, snapshot); err != nil {
+		h.log(r).Error("delete snapshot failed", "name", name, "snapshot", snapshot, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (h *Handlers) handleReset(w http.ResponseWriter, r *http.Request, name string) {
+	snapshot := r.URL.Query().Get("snapshot")
+	resp, err := h.Snapshots.Reset(r.Context(), name, snapshot)
+	if err != nil {
+		h.log(r).Error("reset failed", "name", name, "snapshot", snapshot, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleClone(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.CloneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.Cloner.Clone(r.Context(), name, req, r.Host)
+	if err != nil {
+		h.log(r).Error("clone failed", "source", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleGetMasking(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.MaskingSvc.Get(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("get masking rules failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleSetMasking(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.MaskingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.MaskingSvc.Set(r.Context(), name, req.Rules)
+	if err != nil {
+		h.log(r).Error("set masking rules failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleUpgrade(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.UpgradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.Upgrader.Upgrade(r.Context(), name, req)
+	if err != nil {
+		h.log(r).Error("upgrade failed", "name", name, "version", req.Version, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleUpgradeResult(w http.ResponseWriter, r *http.Request, name string, fn func(context.Context, string) (model.UpgradeResponse, error)) {
+	resp, err := fn(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("finish upgrade failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleUpdateImage(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.Updater.Update(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("image update failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleSetMaintenanceWindow(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.MaintenanceWindowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	if err := h.Updater.SetMaintenanceWindow(r.Context(), name, req.Window); err != nil {
+		h.log(r).Error("set maintenance window failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (h *Handlers) handleListExtensions(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.Extensions.List(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("list extensions failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleCreateExtension(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.CreateExtensionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.Extensions.Create(r.Context(), name, req)
+	if err != nil {
+		h.log(r).Error("create extension failed", "name", name, "extension", req.Name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleGetParameters(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.Parameters.Get(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("get parameters failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handlePatchParameters(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.PatchParametersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.Parameters.Patch(r.Context(), name, req)
+	if err != nil {
+		h.log(r).Error("set parameters failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleListQueries(w http.ResponseWriter, r *http.Request, name string) {
+	sort := r.URL.Query().Get("sort")
+	limit := 0
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			writeInvalid(w, r, "limit", "limit must be a number")
+			return
+		}
+		limit = n
+	}
+
+	resp, err := h.Queries.Top(r.Context(), name, sort, limit)
+	if err != nil {
+		h.log(r).Error("list queries failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleResetQueries(w http.ResponseWriter, r *http.Request, name string) {
+	if err := h.Queries.Reset(r.Context(), name); err != nil {
+		h.log(r).Error("reset queries failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (h *Handlers) handleListActivity(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.Activity.List(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("list activity failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleSignalSession(w http.ResponseWriter, r *http.Request, name, rawPID, action string, fn func(context.Context, string, int) error) {
+	pid, err := strconv.Atoi(rawPID)
+	if err != nil || pid <= 0 {
+		writeInvalid(w, r, "pid", "pid must be a positive number")
+		return
+	}
+
+	if err := fn(r.Context(), name, pid); err != nil {
+		h.log(r).Error(action+" session failed", "name", name, "pid", pid, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	h.log(r).Info("session signalled", "name", name, "pid", pid, "action", action)
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (h *Handlers) handleLogs(w http.ResponseWriter, r *http.Request, name string) {
+	q := r.URL.Query()
+	req := model.LogsRequest{Tail: -1, Since: q.Get("since"), Severity: q.Get("severity")}
+	if raw := q.Get("tail"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			writeInvalid(w, r, "tail", "tail must be a non-negative number")
+			return
+		}
+		req.Tail = n
+	}
+
+	if q.Get("follow") != "true" {
+		resp, err := h.Logs.Read(r.Context(), name, req)
+		if err != nil {
+			h.log(r).Error("read logs failed", "name", name, "error", err)
+			writeFailure(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	// Entries are sent as server-sent events, one JSON entry per event.
+	flusher, _ := w.(http.Flusher)
+	started := false
+	ready := func(source string) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Log-Source", source)
+		w.WriteHeader(http.StatusOK)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		started = true
+	}
+	emit := func(e model.LogEntry) error {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	err := h.Logs.Follow(r.Context(), name, req, ready, emit)
+	switch {
+	case err == nil:
+	case !started:
+		h.log(r).Error("follow logs failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+	case r.Context().Err() == nil:
+		h.log(r).Error("follow logs failed", "name", name, "error", err)
+		_, body := errorResponse(r, err)
+		b, _ := json.Marshal(body)
+		_, _ = fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+	}
+}
+
+func (h *Handlers) handleMigrateRoles(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.Admin.Migrate(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("migrate roles failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleRotateCredentials(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.RotateCredentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.Credentials.Rotate(r.Context(), name, req)
+	if err != nil {
+		h.log(r).Error("rotate credentials failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleListCredentials(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.Credentials.List(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("list credentials failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleIssueCredential(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.IssueCredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.Credentials.Issue(r.Context(), name, req)
+	if err != nil {
+		h.log(r).Error("issue credential failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleListDatabases(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.Databases.List(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("list databases failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleCreateDatabase(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.CreateDatabaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.Databases.Create(r.Context(), name, req)
+	if err != nil {
+		h.log(r).Error("create database failed", "name", name, "database", req.Name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleDropDatabase(w http.ResponseWriter, r *http.Request, name, db string) {
+	if err := h.Databases.Drop(r.Context(), name, db); err != nil {
+		h.log(r).Error("drop database failed", "name", name, "database", db, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (h *Handlers) handleListRoles(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := h.Roles.List(r.Context(), name)
+	if err != nil {
+		h.log(r).Error("list roles failed", "name", name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleCreateRole(w http.ResponseWriter, r *http.Request, name string) {
+	var req model.CreateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "invalid json body", nil)
+		return
+	}
+
+	resp, err := h.Roles.Create(r.Context(), name, req)
+	if err != nil {
+		h.log(r).Error("create role failed", "name", name, "role", req.Name, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleRotateRole(w http.ResponseWriter, r *http.Request, name, role string) {
+	resp, err := h.Roles.Rotate(r.Context(), name, role)
+	if err != nil {
+		h.log(r).Error("rotate role failed", "name", name, "role", role, "error", err)
+		writeFailure(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handlers) handleDropRole(w http.ResponseWriter, r *http.Request, name, role string) {
+	if err := h.Roles.Drop(r.Context(), name, role); err != nil {
+		h.log(r).Error("drop role failed", "name", name, "role", role, "error", err)
+		writeFailure(w, r, err)
 		return
 	}
 
 	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
 }
 
-func matchesDBDeletePath(path string) bool {
-	return len(path) > len("/v1/db/") && path[:len("/v1/db/")] == "/v1/db/"
+// splitDBPath splits /v1/db/{name}/rest... into the database name and the
+// remaining path segments.
+func splitDBPath(path string) (string, []string, bool) {
+	return splitPath(path, "/v1/db/")
 }
 
-func parseNameFromPath(path string) (string, error) {
-	if !matchesDBDeletePath(path) {
-		return "", fmt.Errorf("invalid destroy path")
+// splitPath splits prefix{name}/rest... into the name and the remaining
+// path segments.
+func splitPath(path, prefix string) (string, []string, bool) {
+	if !strings.HasPrefix(path, prefix) {
+		return "", nil, false
 	}
-	name := path[len("/v1/db/"):]
-	if name == "" {
-		return "", fmt.Errorf("database name is required")
+	parts := strings.Split(strings.TrimSuffix(path[len(prefix):], "/"), "/")
+	if parts[0] == "" {
+		return "", nil, false
 	}
-	return name, nil
+	return parts[0], parts[1:], true
+}
+
+// matchRest reports whether the segments after the database name match
+// pattern, where "*" matches any single segment.
+func matchRest(rest []string, pattern ...string) bool {
+	if len(rest) != len(pattern) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != rest[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func writeJSON(w http.ResponseWriter, status int, payload any) {
@@ -109,3 +929,57 @@ func writeJSON(w http.ResponseWriter, status int, payload any) {
 	w.WriteHeader(status)
 	_ = json.NewEncoder(w).Encode(payload)
 }
+
+// Error codes set by the API itself; core sets not_found, conflict and
+// validation_failed.
+const (
+	codeInvalidJSON      = "invalid_json"
+	codeUnauthorized     = "unauthorized"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeUnavailable      = "runtime_unavailable"
+	codeInternal         = "internal"
+)
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, details map[string]any) {
+	if details == nil {
+		details = map[string]any{}
+	}
+	writeJSON(w, status, model.ErrorResponse{Code: code, Message: message, Details: details, RequestID: RequestID(r.Context())})
+}
+
+// writeInvalid rejects a request parameter the handler checked itself.
+func writeInvalid(w http.ResponseWriter, r *http.Request, field, message string) {
+	writeError(w, r, http.StatusUnprocessableEntity, core.CodeValidation, message, map[string]any{"field": field})
+}
+
+// writeFailure writes err with the status its kind maps to.
+func writeFailure(w http.ResponseWriter, r *http.Request, err error) {
+	status, body := errorResponse(r, err)
+	writeJSON(w, status, body)
+}
+
+// errorResponse maps err to a status and body: request errors from core
+// by their code, an unreachable docker to 503, and anything else to 500.
+func errorResponse(r *http.Request, err error) (int, model.ErrorResponse) {
+	body := model.ErrorResponse{Code: codeInternal, Message: err.Error(), Details: map[string]any{}, RequestID: RequestID(r.Context())}
+	status := http.StatusInternalServerError
+	if docker.IsUnavailable(err) {
+		body.Code = codeUnavailable
+		return http.StatusServiceUnavailable, body
+	}
+	if e, ok := core.AsError(err); ok {
+		body.Code = e.Code
+		if e.Details != nil {
+			body.Details = e.Details
+		}
+		switch e.Code {
+		case core.CodeNotFound:
+			status = http.StatusNotFound
+		case core.CodeConflict:
+			status = http.StatusConflict
+		case core.CodeValidation:
+			status = http.StatusUnprocessableEntity
+		}
+	}
+	return status, body
+}
@@ -1,31 +1,373 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"pgdb/daemon/internal/audit"
+	"pgdb/daemon/internal/metrics"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/tracing"
 )
 
 func AuthMiddleware(token string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if token == "" {
-			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": "server token is not configured"})
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "server token is not configured", nil)
 			return
 		}
 
 		header := r.Header.Get("Authorization")
 		const prefix = "Bearer "
 		if !strings.HasPrefix(header, prefix) {
-			writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "missing or invalid authorization header"})
+			writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "missing or invalid authorization header", nil)
 			return
 		}
 
 		provided := strings.TrimSpace(strings.TrimPrefix(header, prefix))
 		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
-			writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "invalid token"})
+			writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "invalid token", nil)
 			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// requestIDHeader carries the request ID in both directions. Clients and
+// proxies may set it to correlate their own logs with the daemon's.
+const requestIDHeader = "X-Request-ID"
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// RequestIDMiddleware gives every request an ID: the one in X-Request-ID
+// when it is well-formed, a random one otherwise. The ID is echoed in the
+// response header and is available to handlers through RequestID.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRe.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID returns the ID RequestIDMiddleware gave the request, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLogMiddleware logs one line per request once it is done. Probes
+// and scrapes are logged at debug level so they do not drown the rest.
+func AccessLogMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if isProbe(r.URL.Path) {
+			level = slog.LevelDebug
+		}
+		logger.LogAttrs(r.Context(), level, "request",
+			slog.String("request_id", RequestID(r.Context())),
+			slog.String("trace_id", tracing.FromContext(r.Context()).TraceID()),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", routeLabel(r.URL.Path)),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
+
+// TracingMiddleware starts a server span per request, continuing the
+// caller's trace when it sent a traceparent header. The span carries the
+// request ID, and logs carry the trace ID, so either finds the other.
+// Probes and scrapes are not traced.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isProbe(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := routeLabel(r.URL.Path)
+		ctx, span := tracing.StartServer(r.Context(), r.Method+" "+route, r.Header.Get("traceparent"),
+			"http.method", r.Method, "http.route", route, "http.target", r.URL.Path, "request_id", RequestID(r.Context()))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttr("http.status_code", rec.status)
+		var err error
+		if rec.status >= 500 {
+			err = errors.New(http.StatusText(rec.status))
+		}
+		span.End(err)
+	})
+}
+
+// isProbe reports whether path is polled by load balancers or scrapers.
+func isProbe(path string) bool {
+	switch path {
+	case "/healthz", "/readyz", "/metrics":
+		return true
+	}
+	return false
+}
+
+// MetricsMiddleware counts requests and records their latency. Routes are
+// labelled by their pattern, not the raw path, so database names do not
+// multiply the series.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := routeLabel(r.URL.Path)
+		metrics.HTTPRequests.Inc(route, r.Method, strconv.Itoa(rec.status))
+		metrics.HTTPDuration.Observe(time.Since(start).Seconds(), route)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// routeSegments are the fixed path segments after /v1/db/{name}; any other
+// segment there is a sub-resource name.
+var routeSegments = map[string]bool{
+	"lease": true, "snapshots": true, "reset": true, "clone": true, "masking": true,
+	"upgrade": true, "confirm": true, "rollback": true, "update-image": true,
+	"maintenance-window": true, "extensions": true, "parameters": true, "queries": true, "migrate-roles": true,
+	"activity": true, "cancel": true, "terminate": true, "logs": true,
+	"rotate-credentials": true, "credentials": true, "databases": true, "roles": true, "rotate": true,
+}
+
+func routeLabel(path string) string {
+	switch path {
+	case "/v1/deploy", "/v1/status", "/v1/versions", "/v1/events", "/v1/webhooks", "/v1/audit", "/metrics", "/healthz", "/readyz":
+		return path
+	}
+	if _, rest, ok := splitPath(path, "/v1/webhooks/"); ok && len(rest) == 1 && (rest[0] == "deliveries" || rest[0] == "test") {
+		return "/v1/webhooks/{name}/" + rest[0]
+	}
+	_, rest, isDB := splitDBPath(path)
+	if !isDB {
+		return "other"
+	}
+	route := "/v1/db/{name}"
+	for _, seg := range rest {
+		if !routeSegments[seg] {
+			seg = "{id}"
+		}
+		route += "/" + seg
+	}
+	return route
+}
+
+// maxAuditBody is how much of a request body is parsed for the audit log.
+const maxAuditBody = 1 << 20
+
+// redactedKeys are substrings of JSON keys and query parameters whose
+// values never reach the audit log.
+var redactedKeys = []string{"password", "secret", "token", "database_url"}
+
+// AuditMiddleware records every mutating request, authorized or not, in
+// the audit log once it has been handled. Requests are attributed to a
+// fingerprint of the token they presented, never the token itself.
+func AuditMiddleware(log *audit.Log, token string, logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		var body []byte
+		if r.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(r.Body, maxAuditBody))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		}
+		rec := &auditRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		next.ServeHTTP(rec, r)
+
+		sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			sourceIP = r.RemoteAddr
+		}
+		entry := audit.Record{
+			Time:         time.Now().UTC().Format(time.RFC3339Nano),
+			RequestID:    RequestID(r.Context()),
+			Identity:     tokenIdentity(r, token),
+			SourceIP:     sourceIP,
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Action:       r.Method + " " + routeLabel(r.URL.Path),
+			Path:         r.URL.Path,
+			Database:     auditDatabase(r, body, rec),
+			Params:       auditParams(r, body),
+			Status:       rec.status,
+			Outcome:      "success",
+			DurationMS:   time.Since(start).Milliseconds(),
+		}
+		if rec.status >= 400 {
+			entry.Outcome = "failure"
+			var payload model.ErrorResponse
+			_ = json.Unmarshal(rec.body.Bytes(), &payload)
+			entry.Error = payload.Message
+		}
+		if err := log.Append(entry); err != nil {
+			logger.Error("audit log write failed", "action", entry.Action, "path", entry.Path, "error", err)
+		}
+	})
+}
+
+// auditRecorder keeps the start of the response so the outcome and the
+// name of a deployed database can be recorded.
+type auditRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (a *auditRecorder) Write(b []byte) (int, error) {
+	if room := 64*1024 - a.body.Len(); room > 0 {
+		a.body.Write(b[:min(len(b), room)])
+	}
+	return a.statusRecorder.Write(b)
+}
+
+func tokenIdentity(r *http.Request, token string) string {
+	provided := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	switch {
+	case provided == "":
+		return "anonymous"
+	case token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1:
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:])[:12]
+	default:
+		return "invalid-token"
+	}
+}
+
+// auditDatabase names the database a request acted on: the one in the
+// path, or for deploys and clones the one created, from the response.
+func auditDatabase(r *http.Request, body []byte, rec *auditRecorder) string {
+	var payload struct {
+		Name string `json:"name"`
+	}
+	name, rest, _ := splitDBPath(r.URL.Path)
+	creates := r.URL.Path == "/v1/deploy" || matchRest(rest, "clone")
+	switch {
+	case creates && rec.status < 400:
+		_ = json.Unmarshal(rec.body.Bytes(), &payload)
+		return payload.Name
+	case r.URL.Path == "/v1/deploy":
+		_ = json.Unmarshal(body, &payload)
+		return payload.Name
+	}
+	return name
+}
+
+// auditParams returns the query string and JSON body of a request with
+// secret values replaced.
+func auditParams(r *http.Request, body []byte) json.RawMessage {
+	params := map[string]any{}
+	if q := r.URL.Query(); len(q) > 0 {
+		query := make(map[string]any, len(q))
+		for k, values := range q {
+			query[k] = values
+		}
+		params["query"] = redact(query)
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		var v any
+		if err := json.Unmarshal(body, &v); err == nil {
+			params["body"] = redact(v)
+		} else {
+			params["body_bytes"] = len(body)
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func redact(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, val := range t {
+			lower := strings.ToLower(k)
+			secret := false
+			for _, key := range redactedKeys {
+				if strings.Contains(lower, key) {
+					secret = true
+				}
+			}
+			if secret {
+				t[k] = "[redacted]"
+			} else {
+				t[k] = redact(val)
+			}
+		}
+	case []any:
+		for i := range t {
+			t[i] = redact(t[i])
+		}
+	}
+	return v
+}
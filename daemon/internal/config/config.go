@@ -0,0 +1,280 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pgdb/daemon/internal/events"
+)
+
+var (
+	flavorRe      = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+	webhookNameRe = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+)
+
+// defaultDiskThreshold is the volume usage, in percent, above which the
+// monitor publishes a disk event.
+const defaultDiskThreshold = 85
+
+type Config struct {
+	Postgres Postgres  `json:"postgres"`
+	Monitor  Monitor   `json:"monitor"`
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+}
+
+type Monitor struct {
+	DiskThresholdPercent int `json:"disk_threshold_percent,omitempty"`
+}
+
+type Webhook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret is the HMAC-SHA256 key payloads are signed with.
+	Secret string `json:"secret"`
+	// Events lists the event types to deliver; empty means all.
+	Events []string `json:"events,omitempty"`
+}
+
+// Wants reports whether the webhook subscribes to the event type.
+func (w Webhook) Wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type Postgres struct {
+	DefaultVersion int                `json:"default_version"`
+	Versions       map[string]Version `json:"versions"`
+}
+
+type Version struct {
+	// Image is any reference docker run accepts, e.g. "postgres:16",
+	// "registry.internal/postgres:16" or "postgres@sha256:...".
+	Image      string `json:"image"`
+	EOL        string `json:"eol,omitempty"`
+	Deprecated bool   `json:"deprecated,omitempty"`
+	// Flavors maps a flavor name such as "postgis" or "pgvector" to the
+	// image that bundles it for this major.
+	Flavors map[string]string `json:"flavors,omitempty"`
+	// PoolSize is how many ready, unnamed instances of the default image
+	// to keep for instant deploys.
+	PoolSize int `json:"pool_size,omitempty"`
+}
+
+// Default mirrors the upstream support policy for the majors pgdb has
+// always offered.
+func Default() Config {
+	eol := map[int]string{
+		12: "2024-11-21",
+		13: "2025-11-13",
+		14: "2026-11-12",
+		15: "2027-11-11",
+		16: "2028-11-09",
+		17: "2029-11-08",
+	}
+
+	versions := make(map[string]Version, len(eol))
+	for major, date := range eol {
+		key := strconv.Itoa(major)
+		versions[key] = Version{Image: "postgres:" + key, EOL: date}
+	}
+
+	return Config{
+		Postgres: Postgres{DefaultVersion: 16, Versions: versions},
+		Monitor:  Monitor{DiskThresholdPercent: defaultDiskThreshold},
+	}
+}
+
+// Load reads the daemon config file. A missing file yields Default(); a
+// present "postgres.versions" map replaces the default set entirely.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return Config{}, fmt.Errorf("read config: %w", err)
+	}
+
+	var file Config
+	if err := json.Unmarshal(b, &file); err != nil {
+		return Config{}, fmt.Errorf("parse config json: %w", err)
+	}
+
+	if file.Postgres.Versions != nil {
+		cfg.Postgres.Versions = file.Postgres.Versions
+	}
+	if file.Postgres.DefaultVersion != 0 {
+		cfg.Postgres.DefaultVersion = file.Postgres.DefaultVersion
+	}
+	if file.Monitor.DiskThresholdPercent != 0 {
+		cfg.Monitor.DiskThresholdPercent = file.Monitor.DiskThresholdPercent
+	}
+	cfg.Webhooks = file.Webhooks
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func (c Config) validate() error {
+	if len(c.Postgres.Versions) == 0 {
+		return fmt.Errorf("config: postgres.versions must list at least one major version")
+	}
+	for key, v := range c.Postgres.Versions {
+		if major, err := strconv.Atoi(key); err != nil || major <= 0 {
+			return fmt.Errorf("config: postgres.versions key '%s' must be a major integer", key)
+		}
+		if strings.TrimSpace(v.Image) == "" {
+			return fmt.Errorf("config: postgres.versions.%s.image is required", key)
+		}
+		for flavor, image := range v.Flavors {
+			if !flavorRe.MatchString(flavor) {
+				return fmt.Errorf("config: postgres.versions.%s.flavors key '%s' must match %s", key, flavor, flavorRe.String())
+			}
+			if strings.TrimSpace(image) == "" {
+				return fmt.Errorf("config: postgres.versions.%s.flavors.%s image is required", key, flavor)
+			}
+		}
+		if v.PoolSize < 0 || v.PoolSize > 50 {
+			return fmt.Errorf("config: postgres.versions.%s.pool_size must be between 0 and 50", key)
+		}
+		if v.EOL != "" {
+			if _, err := time.Parse(time.DateOnly, v.EOL); err != nil {
+				return fmt.Errorf("config: postgres.versions.%s.eol must be YYYY-MM-DD", key)
+			}
+		}
+	}
+	if _, ok := c.Postgres.Versions[strconv.Itoa(c.Postgres.DefaultVersion)]; !ok {
+		return fmt.Errorf("config: postgres.default_version %d is not in postgres.versions", c.Postgres.DefaultVersion)
+	}
+	if t := c.Monitor.DiskThresholdPercent; t < 1 || t > 100 {
+		return fmt.Errorf("config: monitor.disk_threshold_percent must be between 1 and 100")
+	}
+	return c.validateWebhooks()
+}
+
+func (c Config) validateWebhooks() error {
+	known := map[string]bool{}
+	for _, t := range events.Types {
+		known[t] = true
+	}
+
+	seen := map[string]bool{}
+	for i, w := range c.Webhooks {
+		if !webhookNameRe.MatchString(w.Name) {
+			return fmt.Errorf("config: webhooks[%d].name must match %s", i, webhookNameRe.String())
+		}
+		if seen[w.Name] {
+			return fmt.Errorf("config: webhook '%s' is defined twice", w.Name)
+		}
+		seen[w.Name] = true
+
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("config: webhooks.%s.url must be an http or https URL", w.Name)
+		}
+		if strings.TrimSpace(w.Secret) == "" {
+			return fmt.Errorf("config: webhooks.%s.secret is required", w.Name)
+		}
+		for _, e := range w.Events {
+			if !known[e] {
+				return fmt.Errorf("config: webhooks.%s.events has unknown event type '%s' (known: %s)", w.Name, e, strings.Join(events.Types, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+func (c Config) AllowedVersions() []int {
+	out := make([]int, 0, len(c.Postgres.Versions))
+	for key := range c.Postgres.Versions {
+		major, _ := strconv.Atoi(key)
+		out = append(out, major)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// CheckVersion rejects majors that new deploys and upgrades may not use.
+func (c Config) CheckVersion(version int) error {
+	if _, ok := c.Postgres.Versions[strconv.Itoa(version)]; ok {
+		return nil
+	}
+
+	allowed := c.AllowedVersions()
+	parts := make([]string, 0, len(allowed))
+	for _, major := range allowed {
+		parts = append(parts, strconv.Itoa(major))
+	}
+	return fmt.Errorf("version %d is not supported (allowed: %s)", version, strings.Join(parts, ", "))
+}
+
+// Image returns the configured image for a major version and flavor, where
+// the empty flavor is the stock image. Versions that were removed from the
+// config fall back to Docker Hub so existing stock databases can still be
+// restarted; flavors have no such fallback.
+func (c Config) Image(version, flavor string) (string, error) {
+	v, ok := c.Postgres.Versions[version]
+	if flavor == "" {
+		if ok {
+			return v.Image, nil
+		}
+		return "postgres:" + version, nil
+	}
+
+	if image, found := v.Flavors[flavor]; ok && found {
+		return image, nil
+	}
+	return "", fmt.Errorf("flavor '%s' is not configured for version %s", flavor, version)
+}
+
+func (v Version) FlavorNames() []string {
+	out := make([]string, 0, len(v.Flavors))
+	for flavor := range v.Flavors {
+		out = append(out, flavor)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// EOLWarning describes how close a version is to, or how far past, its end
+// of life. It is empty for versions that are comfortably supported.
+func (v Version) EOLWarning(now time.Time) string {
+	if v.EOL == "" {
+		if v.Deprecated {
+			return "deprecated"
+		}
+		return ""
+	}
+
+	eol, err := time.Parse(time.DateOnly, v.EOL)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case !now.Before(eol):
+		return "reached end of life on " + v.EOL
+	case v.Deprecated:
+		return "deprecated, reaches end of life on " + v.EOL
+	case now.AddDate(1, 0, 0).After(eol):
+		return "reaches end of life on " + v.EOL
+	}
+	return ""
+}
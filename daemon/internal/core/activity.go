@@ -0,0 +1,86 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+)
+
+// clientSessions selects the client sessions of an instance, leaving out
+// background workers, replication connections and the daemon's own psql.
+const clientSessions = `FROM pg_stat_activity a
+	WHERE a.backend_type = 'client backend' AND a.pid <> pg_backend_pid()`
+
+// ActivityService shows the sessions of an instance and cancels or
+// terminates them, for example to release a lock held by a stuck migration.
+type ActivityService struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+}
+
+func (s *ActivityService) traced(ctx context.Context) *ActivityService {
+	t := *s
+	t.Docker = s.Docker.WithContext(ctx)
+	return &t
+}
+
+func (s *ActivityService) List(ctx context.Context, name string) (model.ActivityResponse, error) {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return model.ActivityResponse{}, err
+	}
+
+	query := `SELECT a.pid, a.datname AS database, a.usename AS "user", a.application_name,
+		host(a.client_addr) AS client_addr, a.state, a.wait_event_type, a.wait_event,
+		to_char(a.backend_start AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS backend_start,
+		to_char(a.xact_start AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS xact_start,
+		to_char(a.query_start AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS query_start,
+		a.query, pg_blocking_pids(a.pid) AS blocked_by
+		` + clientSessions + `
+		ORDER BY a.query_start NULLS LAST, a.pid`
+
+	items := []model.Session{}
+	if err := queryJSON(s.Docker, item, query, &items); err != nil {
+		return model.ActivityResponse{}, fmt.Errorf("load activity: %w", err)
+	}
+	return model.ActivityResponse{Name: name, Items: items}, nil
+}
+
+// Cancel stops the session's current query but keeps it connected.
+func (s *ActivityService) Cancel(ctx context.Context, name string, pid int) error {
+	return s.signal(ctx, name, pid, "pg_cancel_backend", "cancel")
+}
+
+// Terminate closes the session, rolling back its open transaction.
+func (s *ActivityService) Terminate(ctx context.Context, name string, pid int) error {
+	return s.signal(ctx, name, pid, "pg_terminate_backend", "terminate")
+}
+
+func (s *ActivityService) signal(ctx context.Context, name string, pid int, fn, action string) error {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return err
+	}
+
+	var rows []struct {
+		OK bool `json:"ok"`
+	}
+	query := fmt.Sprintf("SELECT %s(a.pid) AS ok %s AND a.pid = %d", fn, clientSessions, pid)
+	if err := queryJSON(s.Docker, item, query, &rows); err != nil {
+		return fmt.Errorf("%s session %d: %w", action, pid, err)
+	}
+	if len(rows) == 0 {
+		return notFound("session %d not found in '%s'", pid, name)
+	}
+	if !rows[0].OK {
+		return fmt.Errorf("could not %s session %d", action, pid)
+	}
+	return nil
+}
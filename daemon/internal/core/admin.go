@@ -0,0 +1,194 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/util"
+)
+
+// adminUser is the bootstrap superuser of every cluster deployed with a
+// separate app role. Its password never leaves the daemon.
+const adminUser = "pgdb_admin"
+
+// adminRole is the role the daemon uses for its own SQL. Databases deployed
+// before app roles were split out only have the app user, which is still a
+// superuser there.
+func adminRole(item model.DBInstance) string {
+	if item.AdminUser != "" {
+		return item.AdminUser
+	}
+	return item.User
+}
+
+func adminPassword(item model.DBInstance) string {
+	if item.AdminUser != "" {
+		return item.AdminPassword
+	}
+	return item.Password
+}
+
+// execSQL runs sql as the admin role in the instance's database.
+func execSQL(d *docker.Client, item model.DBInstance, sql string) (string, error) {
+	return execSQLOn(d, item, item.DB, sql)
+}
+
+// execSQLOn runs sql as the admin role in another database of the instance.
+func execSQLOn(d *docker.Client, item model.DBInstance, db, sql string) (string, error) {
+	return d.ExecSQL(item.ContainerID, adminRole(item), db, sql)
+}
+
+// createAppRole creates the non-superuser login role handed out to apps and
+// makes it the owner of the database and its public schema.
+func createAppRole(d *docker.Client, item model.DBInstance) error {
+	sql := fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD %s NOSUPERUSER NOCREATEDB NOCREATEROLE NOREPLICATION NOBYPASSRLS; "+
+		"ALTER DATABASE %s OWNER TO %s; ALTER SCHEMA public OWNER TO %s;",
+		quoteIdent(item.User), quoteLiteral(item.Password),
+		quoteIdent(item.DB), quoteIdent(item.User), quoteIdent(item.User))
+	if _, err := execSQL(d, item, sql); err != nil {
+		return fmt.Errorf("create app role: %w", err)
+	}
+	return nil
+}
+
+// transferOwnershipSQL hands every user-defined schema, relation, routine and
+// type in the current database to owner. Objects that belong to extensions
+// stay with their installer, and sequences owned by a column follow their
+// table.
+func transferOwnershipSQL(owner string) string {
+	return `DO $pgdb$
+DECLARE
+	r record;
+	owner text := ` + quoteLiteral(owner) + `;
+BEGIN
+	FOR r IN SELECT n.oid, n.nspname FROM pg_namespace n
+		WHERE n.nspname NOT LIKE 'pg\_%' AND n.nspname <> 'information_schema'
+		AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_namespace'::regclass AND d.objid = n.oid AND d.deptype = 'e')
+	LOOP
+		EXECUTE format('ALTER SCHEMA %I OWNER TO %I', r.nspname, owner);
+	END LOOP;
+
+	FOR r IN SELECT c.oid::regclass AS rel, c.relkind FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname NOT LIKE 'pg\_%' AND n.nspname <> 'information_schema'
+		AND c.relkind IN ('r', 'p', 'v', 'm', 'S', 'f')
+		AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype IN ('e', 'a', 'i'))
+	LOOP
+		EXECUTE format('ALTER %s %s OWNER TO %I',
+			CASE r.relkind WHEN 'S' THEN 'SEQUENCE' WHEN 'v' THEN 'VIEW' WHEN 'm' THEN 'MATERIALIZED VIEW' WHEN 'f' THEN 'FOREIGN TABLE' ELSE 'TABLE' END,
+			r.rel, owner);
+	END LOOP;
+
+	FOR r IN SELECT p.oid::regprocedure AS fn FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE n.nspname NOT LIKE 'pg\_%' AND n.nspname <> 'information_schema'
+		AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_proc'::regclass AND d.objid = p.oid AND d.deptype = 'e')
+	LOOP
+		EXECUTE format('ALTER ROUTINE %s OWNER TO %I', r.fn, owner);
+	END LOOP;
+
+	FOR r IN SELECT t.oid::regtype AS typ, t.typtype FROM pg_type t
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE n.nspname NOT LIKE 'pg\_%' AND n.nspname <> 'information_schema'
+		AND t.typtype IN ('e', 'd', 'r')
+		AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_type'::regclass AND d.objid = t.oid AND d.deptype = 'e')
+	LOOP
+		EXECUTE format('ALTER %s %s OWNER TO %I', CASE r.typtype WHEN 'd' THEN 'DOMAIN' ELSE 'TYPE' END, r.typ, owner);
+	END LOOP;
+END
+$pgdb$;`
+}
+
+// AdminMigrator moves databases deployed with a superuser app role to the
+// split admin/app layout.
+type AdminMigrator struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+}
+
+func (m *AdminMigrator) traced(ctx context.Context) *AdminMigrator {
+	t := *m
+	t.Docker = m.Docker.WithContext(ctx)
+	return &t
+}
+
+// Migrate renames the legacy bootstrap superuser to the admin role and
+// recreates the app role under its old name and password as a
+// non-superuser owner. The bootstrap role cannot lose SUPERUSER, and the
+// current session user cannot be renamed, so a temporary superuser does
+// the rename. Sessions of the old role are terminated so apps reconnect
+// with reduced privileges. Every step can be repeated, so calling Migrate
+// again after a failure resumes where the previous attempt stopped.
+func (m *AdminMigrator) Migrate(ctx context.Context, name string) (model.DeployResponse, error) {
+	m = m.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, m.LockPath)
+	if err != nil {
+		return model.DeployResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(m.RegistryPath)
+	if err != nil {
+		return model.DeployResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.DeployResponse{}, databaseNotFound(name)
+	}
+	if item.AdminUser != "" {
+		return model.DeployResponse{}, conflict("database '%s' already uses a separate admin role", name)
+	}
+
+	password, err := util.RandomPassword(24)
+	if err != nil {
+		return model.DeployResponse{}, err
+	}
+
+	type step struct {
+		user string
+		db   string
+		sql  string
+	}
+	const tempUser = "pgdb_migrate"
+	var steps []step
+	// The admin role only exists once an earlier attempt got past the
+	// rename; the old superuser is gone from then on.
+	if _, err := m.Docker.ExecSQL(item.ContainerID, adminUser, "postgres", "SELECT 1"); err != nil {
+		steps = append(steps,
+			step{item.User, item.DB, "DO $pgdb$ BEGIN IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = " + quoteLiteral(tempUser) + ") THEN " +
+				"CREATE ROLE " + tempUser + " SUPERUSER LOGIN; END IF; END $pgdb$"},
+			step{tempUser, "postgres", fmt.Sprintf("ALTER ROLE %s RENAME TO %s", quoteIdent(item.User), adminUser)},
+		)
+	}
+	appRole := fmt.Sprintf("%s LOGIN PASSWORD %s NOSUPERUSER NOCREATEDB NOCREATEROLE NOREPLICATION NOBYPASSRLS",
+		quoteIdent(item.User), quoteLiteral(item.Password))
+	steps = append(steps,
+		step{adminUser, "postgres", fmt.Sprintf("ALTER ROLE %s PASSWORD %s; SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE usename = %s AND pid <> pg_backend_pid()",
+			adminUser, quoteLiteral(password), quoteLiteral(adminUser))},
+		step{adminUser, "postgres", "DO $pgdb$ BEGIN IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = " + quoteLiteral(item.User) + ") THEN " +
+			"ALTER ROLE " + appRole + "; ELSE CREATE ROLE " + appRole + "; END IF; END $pgdb$"},
+		step{adminUser, item.DB, fmt.Sprintf("ALTER DATABASE %s OWNER TO %s", quoteIdent(item.DB), quoteIdent(item.User))},
+		step{adminUser, item.DB, transferOwnershipSQL(item.User)},
+		step{adminUser, "postgres", "DROP ROLE IF EXISTS " + tempUser},
+	)
+	for i, step := range steps {
+		if _, err := m.Docker.ExecSQL(item.ContainerID, step.user, step.db, step.sql); err != nil {
+			return model.DeployResponse{}, fmt.Errorf("migrate roles of '%s' (step %d of %d): %w", name, i+1, len(steps), err)
+		}
+	}
+
+	item.AdminUser = adminUser
+	item.AdminPassword = password
+	r.Items[idx] = item
+	if err := registry.Save(m.RegistryPath, r); err != nil {
+		return model.DeployResponse{}, err
+	}
+
+	return deployResponse(item), nil
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/events"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/tracing"
+)
+
+type Cloner struct {
+	RegistryPath string
+	LockPath     string
+	Deployer     *Deployer
+	Docker       *docker.Client
+}
+
+func (c *Cloner) traced(ctx context.Context) *Cloner {
+	t := *c
+	t.Deployer = c.Deployer.traced(ctx)
+	t.Docker = c.Docker.WithContext(ctx)
+	return &t
+}
+
+// Clone deploys a new database with the same major version as source,
+// restores a dump of source into it and applies the source's masking rules
+// before the new credentials are handed out.
+func (c *Cloner) Clone(ctx context.Context, source string, req model.CloneRequest, requestHost string) (resp model.DeployResponse, err error) {
+	c.Deployer.Events.Publish(events.DeployStarted, req.Name, map[string]any{"clone_of": source})
+	defer func() { c.Deployer.publishResult(req.Name, resp, err) }()
+
+	ctx, span := tracing.Start(ctx, "clone", "db.source", source, "db.requested_name", req.Name)
+	defer func() {
+		if err == nil {
+			span.SetAttr("db.name", resp.Name)
+		}
+		span.End(err)
+	}()
+	c = c.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, c.LockPath)
+	if err != nil {
+		return model.DeployResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(c.RegistryPath)
+	if err != nil {
+		return model.DeployResponse{}, err
+	}
+
+	src, idx := registry.FindByName(r, source)
+	if idx < 0 {
+		return model.DeployResponse{}, databaseNotFound(source)
+	}
+
+	columns, err := loadColumns(c.Docker, src)
+	if err != nil {
+		return model.DeployResponse{}, err
+	}
+	if issues := validateMaskRules(src.MaskRules, columns); len(issues) > 0 {
+		return model.DeployResponse{}, maskIssuesError(issues)
+	}
+
+	version, err := strconv.Atoi(src.PostgresVersion)
+	if err != nil {
+		return model.DeployResponse{}, fmt.Errorf("invalid postgres version '%s' for '%s'", src.PostgresVersion, source)
+	}
+
+	entry, err := c.Deployer.provision(ctx, &r, model.DeployRequest{
+		Name:       req.Name,
+		SizeGB:     req.SizeGB,
+		Version:    version,
+		Flavor:     src.Flavor,
+		Parameters: src.Parameters,
+		Initdb:     src.Initdb,
+	}, requestHost)
+	if err != nil {
+		return model.DeployResponse{}, err
+	}
+
+	_, err = c.Docker.PipeExec(
+		src.ContainerID, []string{"pg_dump", "-U", adminRole(src), "-d", src.DB, "--no-owner", "--no-privileges"},
+		entry.ContainerID, []string{"psql", "-q", "-U", adminRole(entry), "-d", entry.DB, "-v", "ON_ERROR_STOP=1"},
+	)
+	if err != nil {
+		c.Deployer.discard(entry)
+		return model.DeployResponse{}, fmt.Errorf("copy data from '%s': %w", source, err)
+	}
+
+	// The dump is restored without owners, so hand everything the admin
+	// role just created to the clone's app role.
+	if _, err := execSQL(c.Docker, entry, transferOwnershipSQL(entry.User)); err != nil {
+		c.Deployer.discard(entry)
+		return model.DeployResponse{}, fmt.Errorf("transfer ownership to app role: %w", err)
+	}
+
+	if err := applyMasking(c.Docker, entry, src.MaskRules, columns); err != nil {
+		c.Deployer.discard(entry)
+		return model.DeployResponse{}, err
+	}
+
+	entry.ClonedFrom = src.Name
+	r.Items = append(r.Items, entry)
+	if err := registry.Save(c.RegistryPath, r); err != nil {
+		c.Deployer.discard(entry)
+		return model.DeployResponse{}, err
+	}
+
+	return deployResponse(entry), nil
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"pgdb/daemon/internal/config"
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+)
+
+const readyTimeout = 90 * time.Second
+
+// lookupInstance returns a registry entry for operations that only talk to
+// the running container and do not modify the registry.
+func lookupInstance(ctx context.Context, registryPath, lockPath, name string) (model.DBInstance, error) {
+	unlock, err := registry.AcquireLock(ctx, lockPath)
+	if err != nil {
+		return model.DBInstance{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(registryPath)
+	if err != nil {
+		return model.DBInstance{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.DBInstance{}, databaseNotFound(name)
+	}
+	return item, nil
+}
+
+// loadRegistry reads the registry under the lock and releases it right
+// away, for background readers that must not block deploys for long.
+func loadRegistry(ctx context.Context, registryPath, lockPath string) (model.Registry, error) {
+	unlock, err := registry.AcquireLock(ctx, lockPath)
+	if err != nil {
+		return model.Registry{}, err
+	}
+	defer func() { _ = unlock() }()
+	return registry.Load(registryPath)
+}
+
+// startInstance runs a fresh container for an existing registry entry,
+// keeping its name, port, volume and credentials, and waits until Postgres
+// accepts connections.
+func startInstance(d *docker.Client, item model.DBInstance, image string) (string, error) {
+	containerID, err := d.RunPostgres(docker.RunPostgresOptions{
+		ContainerName: "pgdb-" + item.Name,
+		VolumeName:    item.VolumeName,
+		HostPort:      item.HostPort,
+		DB:            item.DB,
+		User:          adminRole(item),
+		Password:      adminPassword(item),
+		Image:         image,
+		InitdbArgs:    initdbArgs(item.Initdb),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := d.WaitReady(containerID, adminRole(item), item.DB, readyTimeout); err != nil {
+		_ = d.RemoveContainerForce(containerID)
+		return "", err
+	}
+
+	return containerID, nil
+}
+
+func restartInstance(d *docker.Client, item model.DBInstance) error {
+	if err := d.RestartContainer(item.ContainerID); err != nil {
+		return err
+	}
+	return d.WaitReady(item.ContainerID, adminRole(item), item.DB, readyTimeout)
+}
+
+// instanceImage resolves the image an existing database runs on. If its
+// flavor is no longer configured, the recorded digest keeps it startable.
+func instanceImage(cfg *config.Config, item model.DBInstance) (string, error) {
+	image, err := cfg.Image(item.PostgresVersion, item.Flavor)
+	if err != nil && item.ImageDigest != "" {
+		return item.ImageDigest, nil
+	}
+	return image, err
+}
+
+// imageDigest is best effort: an empty digest only means a later image
+// update cannot roll back to the exact previous image.
+func imageDigest(d *docker.Client, image string) string {
+	digest, err := d.ImageDigest(image)
+	if err != nil {
+		return ""
+	}
+	return digest
+}
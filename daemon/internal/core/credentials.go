@@ -0,0 +1,347 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/util"
+)
+
+const (
+	defaultGracePeriod = 24 * time.Hour
+	maxGracePeriod     = 30 * 24 * time.Hour
+
+	defaultCredentialTTL = time.Hour
+	minCredentialTTL     = time.Minute
+	maxCredentialTTL     = 7 * 24 * time.Hour
+)
+
+// CredentialService rotates the primary credential of a database and issues
+// short-lived credentials. Postgres roles only have one password, so
+// rotation creates a new login role that acts as the owning role, and the
+// previous login keeps working until its grace period ends.
+type CredentialService struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+	Logger       *slog.Logger
+}
+
+func (s *CredentialService) traced(ctx context.Context) *CredentialService {
+	t := *s
+	t.Docker = s.Docker.WithContext(ctx)
+	return &t
+}
+
+// ownerRole is the role that owns the database's objects. It starts out as
+// the app user and stays fixed when the login user is rotated.
+func ownerRole(item model.DBInstance) string {
+	if item.OwnerRole != "" {
+		return item.OwnerRole
+	}
+	return item.User
+}
+
+func (s *CredentialService) Rotate(ctx context.Context, name string, req model.RotateCredentialsRequest) (model.RotateCredentialsResponse, error) {
+	s = s.traced(ctx)
+
+	grace := defaultGracePeriod
+	if raw := strings.TrimSpace(req.GracePeriod); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 || d > maxGracePeriod {
+			return model.RotateCredentialsResponse{}, invalidField("grace_period", "invalid grace_period '%s' (must be a duration between 0s and %s)", raw, maxGracePeriod)
+		}
+		grace = d
+	}
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.RotateCredentialsResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.RotateCredentialsResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.RotateCredentialsResponse{}, databaseNotFound(name)
+	}
+	if err := checkRoleSupport(item); err != nil {
+		return model.RotateCredentialsResponse{}, err
+	}
+
+	userSuffix, err := util.RandomLowerAlphaNum(10)
+	if err != nil {
+		return model.RotateCredentialsResponse{}, err
+	}
+	password, err := util.RandomPassword(24)
+	if err != nil {
+		return model.RotateCredentialsResponse{}, err
+	}
+
+	owner := ownerRole(item)
+	user := "u_" + userSuffix
+	sql := fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD %s NOSUPERUSER NOCREATEDB NOCREATEROLE NOREPLICATION NOBYPASSRLS IN ROLE %s; "+
+		"ALTER ROLE %s SET role = %s;",
+		quoteIdent(user), quoteLiteral(password), quoteIdent(owner), quoteIdent(user), quoteLiteral(owner))
+	if _, err := execSQL(s.Docker, item, sql); err != nil {
+		return model.RotateCredentialsResponse{}, fmt.Errorf("create login role: %w", err)
+	}
+
+	previous := model.RetiredCredential{
+		User:     item.User,
+		RevokeAt: time.Now().UTC().Add(grace).Format(time.RFC3339),
+	}
+	updated := item
+	updated.OwnerRole = owner
+	updated.User = user
+	updated.Password = password
+	updated.RetiredCredentials = append(append([]model.RetiredCredential{}, item.RetiredCredentials...), previous)
+	r.Items[idx] = updated
+	if err := registry.Save(s.RegistryPath, r); err != nil {
+		_, _ = execSQL(s.Docker, item, dropRoleSQL(item, user))
+		return model.RotateCredentialsResponse{}, err
+	}
+
+	if grace == 0 {
+		s.revokeDue(r, time.Now().UTC())
+	}
+
+	return model.RotateCredentialsResponse{
+		Name:             name,
+		User:             user,
+		Password:         password,
+		DatabaseURL:      makeDatabaseURL(updated),
+		PreviousUser:     previous.User,
+		PreviousRevokeAt: previous.RevokeAt,
+	}, nil
+}
+
+// Issue creates a temporary login role from a privilege template. The role
+// is created with VALID UNTIL so Postgres refuses new logins after the TTL
+// even if the daemon is down; the sweep then terminates its sessions and
+// drops it. The password is only returned here.
+func (s *CredentialService) Issue(ctx context.Context, name string, req model.IssueCredentialRequest) (model.IssuedCredential, error) {
+	s = s.traced(ctx)
+
+	ttl := defaultCredentialTTL
+	if raw := strings.TrimSpace(req.TTL); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < minCredentialTTL || d > maxCredentialTTL {
+			return model.IssuedCredential{}, invalidField("ttl", "invalid ttl '%s' (must be a duration between %s and %s)", raw, minCredentialTTL, maxCredentialTTL)
+		}
+		ttl = d
+	}
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.IssuedCredential{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.IssuedCredential{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.IssuedCredential{}, databaseNotFound(name)
+	}
+	if err := checkRoleSupport(item); err != nil {
+		return model.IssuedCredential{}, err
+	}
+
+	template := strings.ToLower(strings.TrimSpace(req.Template))
+	if template == "" {
+		template = RoleReadOnly
+	}
+	suffix, err := util.RandomLowerAlphaNum(10)
+	if err != nil {
+		return model.IssuedCredential{}, err
+	}
+	user := "tmp_" + suffix
+	grants, err := grantTemplateSQL(item, template, user)
+	if err != nil {
+		return model.IssuedCredential{}, err
+	}
+	password, err := util.RandomPassword(24)
+	if err != nil {
+		return model.IssuedCredential{}, err
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(ttl).Format(time.RFC3339)
+	sql := fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD %s VALID UNTIL %s NOSUPERUSER NOCREATEDB NOCREATEROLE NOREPLICATION NOBYPASSRLS; %s",
+		quoteIdent(user), quoteLiteral(password), quoteLiteral(expiresAt), grants)
+	if _, err := execSQL(s.Docker, item, sql); err != nil {
+		return model.IssuedCredential{}, fmt.Errorf("create temporary role: %w", err)
+	}
+
+	cred := model.DynamicCredential{
+		User:      user,
+		Template:  template,
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: expiresAt,
+	}
+	item.DynamicCredentials = append(item.DynamicCredentials, cred)
+	r.Items[idx] = item
+	if err := registry.Save(s.RegistryPath, r); err != nil {
+		_, _ = execSQL(s.Docker, item, dropRoleSQL(item, user))
+		return model.IssuedCredential{}, err
+	}
+
+	s.Logger.Info("temporary credential issued", "name", name, "user", user, "template", template, "expires_at", expiresAt)
+
+	login := item
+	login.User = user
+	login.Password = password
+	return model.IssuedCredential{
+		Name:        name,
+		User:        user,
+		Password:    password,
+		Template:    template,
+		DatabaseURL: makeDatabaseURL(login),
+		ExpiresAt:   expiresAt,
+	}, nil
+}
+
+// List returns the temporary credentials of a database that have not been
+// reaped yet, with their open session counts.
+func (s *CredentialService) List(ctx context.Context, name string) (model.DynamicCredentialsResponse, error) {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return model.DynamicCredentialsResponse{}, err
+	}
+
+	var sessions []struct {
+		User  string `json:"usename"`
+		Count int    `json:"count"`
+	}
+	if len(item.DynamicCredentials) > 0 {
+		const query = `SELECT usename, count(*) AS count FROM pg_stat_activity WHERE usename LIKE 'tmp\_%' GROUP BY usename`
+		if err := queryJSON(s.Docker, item, query, &sessions); err != nil {
+			return model.DynamicCredentialsResponse{}, fmt.Errorf("count sessions: %w", err)
+		}
+	}
+	counts := make(map[string]int, len(sessions))
+	for _, row := range sessions {
+		counts[row.User] = row.Count
+	}
+
+	items := make([]model.DynamicCredential, 0, len(item.DynamicCredentials))
+	for _, cred := range item.DynamicCredentials {
+		cred.Sessions = counts[cred.User]
+		items = append(items, cred)
+	}
+	return model.DynamicCredentialsResponse{Name: name, Items: items}, nil
+}
+
+// Run revokes retired credentials whose grace period has ended and reaps
+// expired temporary credentials.
+func (s *CredentialService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep(ctx, time.Now().UTC())
+		}
+	}
+}
+
+func (s *CredentialService) sweep(ctx context.Context, now time.Time) {
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		s.Logger.Error("credential sweep: lock registry failed", "error", err)
+		return
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		s.Logger.Error("credential sweep: load registry failed", "error", err)
+		return
+	}
+	s.revokeDue(r, now)
+}
+
+// revokeDue revokes due retired and temporary credentials of every
+// database in r and saves the registry if anything changed. The caller must
+// hold the registry lock. Credentials that fail to revoke stay in the
+// registry and are retried.
+func (s *CredentialService) revokeDue(r model.Registry, now time.Time) {
+	changed := false
+	for i, item := range r.Items {
+		kept := item.RetiredCredentials[:0:0]
+		for _, cred := range item.RetiredCredentials {
+			revokeAt, err := time.Parse(time.RFC3339, cred.RevokeAt)
+			if err == nil && revokeAt.After(now) {
+				kept = append(kept, cred)
+				continue
+			}
+			if _, err := execSQL(s.Docker, item, revokeLoginSQL(item, cred.User)); err != nil {
+				s.Logger.Error("revoke credential failed", "name", item.Name, "user", cred.User, "error", err)
+				kept = append(kept, cred)
+				continue
+			}
+			s.Logger.Info("credential revoked", "name", item.Name, "user", cred.User)
+			changed = true
+		}
+		if len(kept) == 0 {
+			kept = nil
+		}
+		r.Items[i].RetiredCredentials = kept
+
+		live := item.DynamicCredentials[:0:0]
+		for _, cred := range item.DynamicCredentials {
+			expiresAt, err := time.Parse(time.RFC3339, cred.ExpiresAt)
+			if err == nil && expiresAt.After(now) {
+				live = append(live, cred)
+				continue
+			}
+			if _, err := execSQL(s.Docker, item, dropRoleSQL(item, cred.User)); err != nil {
+				s.Logger.Error("reap temporary credential failed", "name", item.Name, "user", cred.User, "error", err)
+				live = append(live, cred)
+				continue
+			}
+			s.Logger.Info("temporary credential expired", "name", item.Name, "user", cred.User)
+			changed = true
+		}
+		if len(live) == 0 {
+			live = nil
+		}
+		r.Items[i].DynamicCredentials = live
+	}
+
+	if !changed {
+		return
+	}
+	if err := registry.Save(s.RegistryPath, r); err != nil {
+		s.Logger.Error("credential sweep: save registry failed", "error", err)
+	}
+}
+
+// revokeLoginSQL ends the sessions of a retired login. The owning role
+// cannot be dropped, so it only loses LOGIN; later login roles are dropped.
+func revokeLoginSQL(item model.DBInstance, user string) string {
+	if user == ownerRole(item) {
+		return fmt.Sprintf("ALTER ROLE %s NOLOGIN; SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE usename = %s;",
+			quoteIdent(user), quoteLiteral(user))
+	}
+	return dropRoleSQL(item, user)
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/util"
+)
+
+var databaseNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{2,62}$`)
+
+// DatabaseService manages extra logical databases inside an instance. Each
+// one gets its own non-superuser owner role, and other roles lose CONNECT
+// on it, so services sharing a container cannot read each other's data.
+type DatabaseService struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+}
+
+func (s *DatabaseService) traced(ctx context.Context) *DatabaseService {
+	t := *s
+	t.Docker = s.Docker.WithContext(ctx)
+	return &t
+}
+
+func (s *DatabaseService) List(ctx context.Context, name string) (model.DatabasesResponse, error) {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return model.DatabasesResponse{}, err
+	}
+	return model.DatabasesResponse{Name: name, Items: databaseInfos(item)}, nil
+}
+
+func (s *DatabaseService) Create(ctx context.Context, name string, req model.CreateDatabaseRequest) (model.DatabaseInfo, error) {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.DatabaseInfo{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.DatabaseInfo{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.DatabaseInfo{}, databaseNotFound(name)
+	}
+	if err := checkRoleSupport(item); err != nil {
+		return model.DatabaseInfo{}, err
+	}
+
+	dbName := strings.ToLower(strings.TrimSpace(req.Name))
+	if dbName == "" {
+		suffix, err := util.RandomLowerAlphaNum(10)
+		if err != nil {
+			return model.DatabaseInfo{}, err
+		}
+		dbName = "pg_" + suffix
+	}
+	if !databaseNameRe.MatchString(dbName) {
+		return model.DatabaseInfo{}, invalidField("name", "invalid database name '%s' (must match %s)", dbName, databaseNameRe.String())
+	}
+	switch {
+	case dbName == "postgres" || strings.HasPrefix(dbName, "template"):
+		return model.DatabaseInfo{}, invalidField("name", "database name '%s' is reserved", dbName)
+	case dbName == item.DB || findDatabase(item, dbName) >= 0 || strings.HasPrefix(dbName, item.DB+"_"):
+		return model.DatabaseInfo{}, conflict("database '%s' already exists in '%s'", dbName, name)
+	}
+
+	userSuffix, err := util.RandomLowerAlphaNum(10)
+	if err != nil {
+		return model.DatabaseInfo{}, err
+	}
+	password, err := util.RandomPassword(24)
+	if err != nil {
+		return model.DatabaseInfo{}, err
+	}
+	db := model.LogicalDatabase{Name: dbName, User: "u_" + userSuffix, Password: password, CreatedAt: util.NowRFC3339()}
+
+	if err := createLogicalDatabase(s.Docker, item, db); err != nil {
+		return model.DatabaseInfo{}, err
+	}
+
+	item.Databases = append(item.Databases, db)
+	r.Items[idx] = item
+	if err := registry.Save(s.RegistryPath, r); err != nil {
+		_ = dropLogicalDatabase(s.Docker, item, db)
+		return model.DatabaseInfo{}, err
+	}
+
+	return databaseInfo(item, db), nil
+}
+
+// Drop terminates the database's sessions and removes it and its owner
+// role.
+func (s *DatabaseService) Drop(ctx context.Context, name, dbName string) error {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return databaseNotFound(name)
+	}
+	di := findDatabase(item, dbName)
+	if di < 0 {
+		return notFound("logical database '%s' not found in '%s'", dbName, name)
+	}
+
+	if err := dropLogicalDatabase(s.Docker, item, item.Databases[di]); err != nil {
+		return err
+	}
+
+	item.Databases = append(item.Databases[:di], item.Databases[di+1:]...)
+	r.Items[idx] = item
+	return registry.Save(s.RegistryPath, r)
+}
+
+// createLogicalDatabase runs each step separately because CREATE DATABASE
+// cannot run inside the implicit transaction of a multi-statement psql -c.
+// Steps already done are undone if a later one fails.
+func createLogicalDatabase(d *docker.Client, item model.DBInstance, db model.LogicalDatabase) error {
+	user := quoteIdent(db.User)
+	name := quoteIdent(db.Name)
+	steps := []struct {
+		db  string
+		sql string
+	}{
+		{"postgres", fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD %s NOSUPERUSER NOCREATEDB NOCREATEROLE NOREPLICATION NOBYPASSRLS",
+			user, quoteLiteral(db.Password))},
+		{"postgres", fmt.Sprintf("CREATE DATABASE %s OWNER %s", name, user)},
+		{db.Name, fmt.Sprintf("REVOKE CONNECT ON DATABASE %s FROM PUBLIC; ALTER SCHEMA public OWNER TO %s", name, user)},
+	}
+	for i, step := range steps {
+		if _, err := execSQLOn(d, item, step.db, step.sql); err != nil {
+			if i > 0 {
+				_ = dropLogicalDatabase(d, item, db)
+			}
+			return sqlInputError(fmt.Errorf("create logical database '%s': %w", db.Name, err), map[string]any{"field": "name"})
+		}
+	}
+	return nil
+}
+
+func dropLogicalDatabase(d *docker.Client, item model.DBInstance, db model.LogicalDatabase) error {
+	steps := []string{
+		fmt.Sprintf("SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE datname = %s", quoteLiteral(db.Name)),
+		"DROP DATABASE IF EXISTS " + quoteIdent(db.Name),
+		"DROP ROLE IF EXISTS " + quoteIdent(db.User),
+	}
+	for _, sql := range steps {
+		if _, err := execSQLOn(d, item, "postgres", sql); err != nil {
+			return fmt.Errorf("drop logical database '%s': %w", db.Name, err)
+		}
+	}
+	return nil
+}
+
+func findDatabase(item model.DBInstance, dbName string) int {
+	for i, db := range item.Databases {
+		if db.Name == dbName {
+			return i
+		}
+	}
+	return -1
+}
+
+func databaseInfo(item model.DBInstance, db model.LogicalDatabase) model.DatabaseInfo {
+	login := item
+	login.DB = db.Name
+	login.User = db.User
+	login.Password = db.Password
+	return model.DatabaseInfo{
+		Name:        db.Name,
+		User:        db.User,
+		Password:    db.Password,
+		DatabaseURL: makeDatabaseURL(login),
+		CreatedAt:   db.CreatedAt,
+	}
+}
+
+func databaseInfos(item model.DBInstance) []model.DatabaseInfo {
+	out := make([]model.DatabaseInfo, 0, len(item.Databases))
+	for _, db := range item.Databases {
+		out = append(out, databaseInfo(item, db))
+	}
+	return out
+}
@@ -1,16 +1,22 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"pgdb/daemon/internal/config"
 	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/events"
+	"pgdb/daemon/internal/metrics"
 	"pgdb/daemon/internal/model"
 	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/tracing"
 	"pgdb/daemon/internal/util"
 )
 
@@ -21,10 +27,26 @@ type Deployer struct {
 	LockPath     string
 	PublicHost   string
 	Docker       *docker.Client
+	Config       *config.Config
+	Events       *events.Log
 }
 
-func (d *Deployer) Deploy(req model.DeployRequest, requestHost string) (model.DeployResponse, error) {
-	unlock, err := registry.AcquireLock(d.LockPath)
+func (d *Deployer) Deploy(ctx context.Context, req model.DeployRequest, requestHost string) (resp model.DeployResponse, err error) {
+	defer metrics.ObserveOperation("deploy", time.Now(), &err)
+	d.Events.Publish(events.DeployStarted, req.Name, map[string]any{"version": req.Version, "flavor": req.Flavor})
+	defer func() { d.publishResult(req.Name, resp, err) }()
+
+	ctx, span := tracing.Start(ctx, "deploy", "db.requested_name", req.Name)
+	defer func() {
+		if err == nil {
+			span.SetAttr("db.name", resp.Name)
+			span.SetAttr("postgres.version", resp.PostgresVersion)
+		}
+		span.End(err)
+	}()
+	d = d.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, d.LockPath)
 	if err != nil {
 		return model.DeployResponse{}, err
 	}
@@ -35,117 +57,244 @@ func (d *Deployer) Deploy(req model.DeployRequest, requestHost string) (model.De
 		return model.DeployResponse{}, err
 	}
 
-	name, err := normalizeOrGenerateName(req.Name)
+	entry, err := d.provision(ctx, &r, req, requestHost)
 	if err != nil {
 		return model.DeployResponse{}, err
 	}
 
-	if _, idx := registry.FindByName(r, name); idx >= 0 {
-		return model.DeployResponse{}, fmt.Errorf("database name '%s' already exists", name)
+	r.Items = append(r.Items, entry)
+	if err := registry.Save(d.RegistryPath, r); err != nil {
+		d.discard(entry)
+		return model.DeployResponse{}, err
+	}
+
+	return deployResponse(entry), nil
+}
+
+// traced returns a copy of d whose docker calls are spans of the trace in
+// ctx. Every service that talks to docker has the same method, called
+// first by its exported methods that reach docker.
+func (d *Deployer) traced(ctx context.Context) *Deployer {
+	t := *d
+	t.Docker = d.Docker.WithContext(ctx)
+	return &t
+}
+
+// publishResult reports how a deploy or clone requested under name ended.
+// name is empty when the daemon generates one.
+func (d *Deployer) publishResult(name string, resp model.DeployResponse, err error) {
+	if err != nil {
+		d.Events.Publish(events.DeployFailed, name, map[string]any{"error": err.Error()})
+		return
+	}
+	d.Events.Publish(events.DeploySucceeded, resp.Name, map[string]any{
+		"postgres_version": resp.PostgresVersion,
+		"flavor":           resp.Flavor,
+		"expires_at":       resp.ExpiresAt,
+	})
+}
+
+// provision validates the request against the loaded registry and returns a
+// ready Postgres instance for it, claimed from the warm pool when possible.
+// The returned entry is not yet saved; the caller must hold the registry
+// lock and either save r or discard the entry.
+func (d *Deployer) provision(ctx context.Context, r *model.Registry, req model.DeployRequest, requestHost string) (model.DBInstance, error) {
+	name, err := normalizeOrGenerateName(req.Name)
+	if err != nil {
+		return model.DBInstance{}, err
+	}
+
+	if _, idx := registry.FindByName(*r, name); idx >= 0 {
+		return model.DBInstance{}, conflict("database name '%s' already exists", name)
 	}
 
 	version := req.Version
 	if version == 0 {
-		version = 16
+		version = d.Config.Postgres.DefaultVersion
+	}
+	if err := d.Config.CheckVersion(version); err != nil {
+		return model.DBInstance{}, invalidField("version", "%w", err)
+	}
+
+	initdb, err := normalizeInitdb(req.Initdb, version)
+	if err != nil {
+		return model.DBInstance{}, err
+	}
+	ttl, expiresAt := strings.TrimSpace(req.TTL), ""
+	if ttl != "" {
+		lease, err := parseTTL(ttl)
+		if err != nil {
+			return model.DBInstance{}, err
+		}
+		expiresAt = time.Now().UTC().Add(lease).Format(time.RFC3339)
+	}
+
+	flavor := strings.ToLower(strings.TrimSpace(req.Flavor))
+	image, err := d.Config.Image(fmt.Sprintf("%d", version), flavor)
+	if err != nil {
+		return model.DBInstance{}, invalidField("flavor", "%w", err)
+	}
+
+	entry, claimed := d.claimPooled(ctx, r, name, version, flavor, initdb)
+	if !claimed {
+		if entry, err = d.startCluster(ctx, "pgdb-"+name, version, image, initdb); err != nil {
+			return model.DBInstance{}, err
+		}
 	}
-	if version < 12 || version > 17 {
-		return model.DeployResponse{}, fmt.Errorf("version must be between 12 and 17")
+
+	entry.Name = name
+	entry.Host = deriveHost(d.PublicHost, requestHost)
+	entry.CreatedAt = util.NowRFC3339()
+	entry.SizeGB = req.SizeGB
+	entry.Flavor = flavor
+	entry.Parameters = mergeParameters(entry.Parameters, req.Parameters)
+	entry.TTL = ttl
+	entry.ExpiresAt = expiresAt
+	if err := configureParameters(d.Docker, entry); err != nil {
+		d.discard(entry)
+		return model.DBInstance{}, err
 	}
+	return entry, nil
+}
+
+// startCluster creates a volume and container named baseName, waits until
+// Postgres is ready, creates the app role and sets the default parameters.
+// The returned entry only has the cluster fields and its default parameters
+// set.
+func (d *Deployer) startCluster(ctx context.Context, baseName string, version int, image string, initdb *model.InitdbOptions) (_ model.DBInstance, err error) {
+	ctx, span := tracing.Start(ctx, "start cluster", "docker.container", baseName, "postgres.version", version)
+	defer func() { span.End(err) }()
+	d = d.traced(ctx)
 
 	dbSuffix, err := util.RandomLowerAlphaNum(10)
 	if err != nil {
-		return model.DeployResponse{}, err
+		return model.DBInstance{}, err
 	}
 	userSuffix, err := util.RandomLowerAlphaNum(10)
 	if err != nil {
-		return model.DeployResponse{}, err
+		return model.DBInstance{}, err
 	}
 	password, err := util.RandomPassword(24)
 	if err != nil {
-		return model.DeployResponse{}, err
+		return model.DBInstance{}, err
+	}
+	adminPass, err := util.RandomPassword(24)
+	if err != nil {
+		return model.DBInstance{}, err
 	}
 
 	dbName := "pg_" + dbSuffix
 	username := "u_" + userSuffix
-	containerName := "pgdb-" + name
-	volumeName := "pgdb-" + name
-	host := deriveHost(d.PublicHost, requestHost)
-	createdAt := util.NowRFC3339()
 
 	var lastErr error
 	for attempt := 1; attempt <= 5; attempt++ {
 		hostPort, err := reservePort()
 		if err != nil {
-			return model.DeployResponse{}, err
+			return model.DBInstance{}, err
 		}
 
-		if err := d.Docker.CreateVolume(volumeName); err != nil {
-			return model.DeployResponse{}, err
+		if err := d.Docker.CreateVolume(baseName); err != nil {
+			return model.DBInstance{}, err
 		}
 
 		containerID, runErr := d.Docker.RunPostgres(docker.RunPostgresOptions{
-			ContainerName:   containerName,
-			VolumeName:      volumeName,
-			HostPort:        hostPort,
-			DB:              dbName,
-			User:            username,
-			Password:        password,
-			PostgresVersion: fmt.Sprintf("%d", version),
+			ContainerName: baseName,
+			VolumeName:    baseName,
+			HostPort:      hostPort,
+			DB:            dbName,
+			User:          adminUser,
+			Password:      adminPass,
+			Image:         image,
+			InitdbArgs:    initdbArgs(initdb),
 		})
 		if runErr != nil {
 			if docker.IsPortAllocationError(runErr) {
-				_ = d.Docker.RemoveVolume(volumeName)
+				_ = d.Docker.RemoveVolume(baseName)
 				lastErr = runErr
 				continue
 			}
-			_ = d.Docker.RemoveVolume(volumeName)
-			return model.DeployResponse{}, runErr
+			_ = d.Docker.RemoveVolume(baseName)
+			return model.DBInstance{}, runErr
 		}
 
-		if err := d.Docker.WaitReady(containerID, username, dbName, 90*time.Second); err != nil {
+		if err := d.Docker.WaitReady(containerID, adminUser, dbName, readyTimeout); err != nil {
 			_ = d.Docker.RemoveContainerForce(containerID)
-			_ = d.Docker.RemoveVolume(volumeName)
-			return model.DeployResponse{}, err
+			_ = d.Docker.RemoveVolume(baseName)
+			return model.DBInstance{}, err
 		}
 
 		entry := model.DBInstance{
-			Name:            name,
 			ContainerID:     containerID,
-			VolumeName:      volumeName,
-			Host:            host,
+			VolumeName:      baseName,
 			HostPort:        hostPort,
 			DB:              dbName,
 			User:            username,
 			Password:        password,
-			CreatedAt:       createdAt,
+			AdminUser:       adminUser,
+			AdminPassword:   adminPass,
 			PostgresVersion: fmt.Sprintf("%d", version),
-			SizeGB:          req.SizeGB,
+			ImageDigest:     imageDigest(d.Docker, image),
+			Initdb:          initdb,
 		}
-		r.Items = append(r.Items, entry)
-		if err := registry.Save(d.RegistryPath, r); err != nil {
-			_ = d.Docker.RemoveContainerForce(containerID)
-			_ = d.Docker.RemoveVolume(volumeName)
-			return model.DeployResponse{}, err
+		if err := createAppRole(d.Docker, entry); err != nil {
+			d.discard(entry)
+			return model.DBInstance{}, err
 		}
-
-		return model.DeployResponse{
-			Name:            entry.Name,
-			Host:            entry.Host,
-			Port:            entry.HostPort,
-			DB:              entry.DB,
-			User:            entry.User,
-			Password:        entry.Password,
-			DatabaseURL:     makeDatabaseURL(entry),
-			CreatedAt:       entry.CreatedAt,
-			PostgresVersion: entry.PostgresVersion,
-		}, nil
+		if err := configureDefaults(d.Docker, &entry, version); err != nil {
+			d.discard(entry)
+			return model.DBInstance{}, err
+		}
+		return entry, nil
 	}
 
 	if lastErr != nil {
-		return model.DeployResponse{}, fmt.Errorf("failed to allocate host port after retries: %w", lastErr)
+		return model.DBInstance{}, fmt.Errorf("failed to allocate host port after retries: %w", lastErr)
+	}
+
+	return model.DBInstance{}, fmt.Errorf("deploy failed")
+}
+
+// discard removes the container and volume of a provisioned entry that
+// never made it into the registry.
+func (d *Deployer) discard(entry model.DBInstance) {
+	_ = d.Docker.RemoveContainerForce(entry.ContainerID)
+	_ = d.Docker.RemoveVolume(entry.VolumeName)
+}
+
+// Versions lists the majors new deploys may use, with EOL warnings.
+func (d *Deployer) Versions() model.VersionsResponse {
+	now := time.Now().UTC()
+	items := []model.VersionInfo{}
+	for _, major := range d.Config.AllowedVersions() {
+		key := strconv.Itoa(major)
+		v := d.Config.Postgres.Versions[key]
+		items = append(items, model.VersionInfo{
+			Version:    major,
+			Image:      v.Image,
+			Default:    major == d.Config.Postgres.DefaultVersion,
+			EOL:        v.EOL,
+			Deprecated: v.Deprecated,
+			Warning:    v.EOLWarning(now),
+			Flavors:    v.FlavorNames(),
+		})
 	}
+	return model.VersionsResponse{DefaultVersion: d.Config.Postgres.DefaultVersion, Items: items}
+}
 
-	return model.DeployResponse{}, fmt.Errorf("deploy failed")
+func deployResponse(entry model.DBInstance) model.DeployResponse {
+	return model.DeployResponse{
+		Name:            entry.Name,
+		Host:            entry.Host,
+		Port:            entry.HostPort,
+		DB:              entry.DB,
+		User:            entry.User,
+		Password:        entry.Password,
+		DatabaseURL:     makeDatabaseURL(entry),
+		CreatedAt:       entry.CreatedAt,
+		PostgresVersion: entry.PostgresVersion,
+		Flavor:          entry.Flavor,
+		ExpiresAt:       entry.ExpiresAt,
+	}
 }
 
 func normalizeOrGenerateName(raw string) (string, error) {
@@ -159,7 +308,7 @@ func normalizeOrGenerateName(raw string) (string, error) {
 
 	name := strings.ToLower(strings.TrimSpace(raw))
 	if !deployNameRe.MatchString(name) {
-		return "", fmt.Errorf("invalid name '%s' (must match %s)", raw, deployNameRe.String())
+		return "", invalidField("name", "invalid name '%s' (must match %s)", raw, deployNameRe.String())
 	}
 
 	return name, nil
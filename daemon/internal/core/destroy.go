@@ -1,20 +1,38 @@
 package core
 
 import (
-	"fmt"
+	"context"
+	"time"
 
 	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/events"
+	"pgdb/daemon/internal/metrics"
+	"pgdb/daemon/internal/model"
 	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/tracing"
 )
 
 type Destroyer struct {
 	RegistryPath string
 	LockPath     string
 	Docker       *docker.Client
+	Events       *events.Log
 }
 
-func (d *Destroyer) Destroy(name string, keepData bool) error {
-	unlock, err := registry.AcquireLock(d.LockPath)
+func (d *Destroyer) traced(ctx context.Context) *Destroyer {
+	t := *d
+	t.Docker = d.Docker.WithContext(ctx)
+	return &t
+}
+
+func (d *Destroyer) Destroy(ctx context.Context, name string, keepData bool) (err error) {
+	defer metrics.ObserveOperation("destroy", time.Now(), &err)
+
+	ctx, span := tracing.Start(ctx, "destroy", "db.name", name, "keep_data", keepData)
+	defer func() { span.End(err) }()
+	d = d.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, d.LockPath)
 	if err != nil {
 		return err
 	}
@@ -25,11 +43,54 @@ func (d *Destroyer) Destroy(name string, keepData bool) error {
 		return err
 	}
 
-	item, idx := registry.FindByName(r, name)
+	_, idx := registry.FindByName(r, name)
 	if idx < 0 {
-		return fmt.Errorf("database '%s' not found", name)
+		return databaseNotFound(name)
+	}
+
+	if err := d.remove(r, idx, keepData); err != nil {
+		return err
 	}
+	d.Events.Publish(events.Destroyed, name, map[string]any{"reason": "request", "keep_data": keepData})
+	return nil
+}
 
+// DestroyExpired destroys an ephemeral database, data included, if its
+// lease has still run out once the registry lock is held. It reports
+// whether the database was destroyed.
+func (d *Destroyer) DestroyExpired(ctx context.Context, name string, now time.Time) (destroyed bool, err error) {
+	start := time.Now()
+	defer func() {
+		if destroyed || err != nil {
+			metrics.ObserveOperation("destroy", start, &err)
+		}
+	}()
+
+	unlock, err := registry.AcquireLock(ctx, d.LockPath)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(d.RegistryPath)
+	if err != nil {
+		return false, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 || !leaseExpired(item, now) {
+		return false, nil
+	}
+
+	if err := d.remove(r, idx, false); err != nil {
+		return true, err
+	}
+	d.Events.Publish(events.Destroyed, name, map[string]any{"reason": "expired", "keep_data": false})
+	return true, nil
+}
+
+func (d *Destroyer) remove(r model.Registry, idx int, keepData bool) error {
+	item := r.Items[idx]
 	if err := d.Docker.RemoveContainerForce(item.ContainerID); err != nil {
 		return err
 	}
@@ -38,6 +99,11 @@ func (d *Destroyer) Destroy(name string, keepData bool) error {
 		if err := d.Docker.RemoveVolume(item.VolumeName); err != nil {
 			return err
 		}
+		if item.PendingUpgrade != nil {
+			if err := d.Docker.RemoveVolume(item.PendingUpgrade.PreviousVolume); err != nil {
+				return err
+			}
+		}
 	}
 
 	r.Items = append(r.Items[:idx], r.Items[idx+1:]...)
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"pgdb/daemon/internal/docker"
+)
+
+// Error codes returned to API clients. They are part of the API and must
+// not change once released.
+const (
+	CodeNotFound   = "not_found"
+	CodeConflict   = "conflict"
+	CodeValidation = "validation_failed"
+)
+
+// Error is a failure caused by the request rather than by the daemon or
+// its runtime: the target does not exist, conflicts with the current
+// state, or the input is invalid.
+type Error struct {
+	Code    string
+	Details map[string]any
+	err     error
+}
+
+func (e *Error) Error() string { return e.err.Error() }
+
+func (e *Error) Unwrap() error { return e.err }
+
+// AsError returns the *Error in err's chain, if any.
+func AsError(err error) (*Error, bool) {
+	var e *Error
+	ok := errors.As(err, &e)
+	return e, ok
+}
+
+func newError(code string, details map[string]any, format string, args ...any) *Error {
+	return &Error{Code: code, Details: details, err: fmt.Errorf(format, args...)}
+}
+
+func notFound(format string, args ...any) error {
+	return newError(CodeNotFound, nil, format, args...)
+}
+
+func conflict(format string, args ...any) error {
+	return newError(CodeConflict, nil, format, args...)
+}
+
+func invalid(format string, args ...any) error {
+	return newError(CodeValidation, nil, format, args...)
+}
+
+// invalidField is a validation failure of one request field.
+func invalidField(field, format string, args ...any) error {
+	return newError(CodeValidation, map[string]any{"field": field}, format, args...)
+}
+
+func databaseNotFound(name string) error {
+	return newError(CodeNotFound, map[string]any{"database": name}, "database '%s' not found", name)
+}
+
+func invalidParameter(name, format string, args ...any) error {
+	return newError(CodeValidation, map[string]any{"parameter": name}, format, args...)
+}
+
+// sqlInputError classifies err from a statement built from request input
+// by its SQLSTATE: values Postgres rejects are validation failures and
+// objects that already exist are conflicts. Other errors, including those
+// not from the server, are returned unchanged.
+func sqlInputError(err error, details map[string]any) error {
+	state := docker.SQLState(err)
+	switch {
+	case state == "":
+		return err
+	case strings.HasPrefix(state, "22"), // data exception, e.g. an invalid parameter value
+		state == "3F000", // invalid schema name
+		state == "42601", // syntax error
+		state == "42602", // invalid name
+		state == "42622", // name too long
+		state == "42704", // undefined object, e.g. an unknown parameter
+		state == "42804", // datatype mismatch
+		state == "42883": // undefined function
+		return &Error{Code: CodeValidation, Details: details, err: err}
+	case state == "42710", state == "42P04", state == "42P06": // duplicate object, database, schema
+		return &Error{Code: CodeConflict, Details: details, err: err}
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+)
+
+type ExtensionService struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+}
+
+func (s *ExtensionService) traced(ctx context.Context) *ExtensionService {
+	t := *s
+	t.Docker = s.Docker.WithContext(ctx)
+	return &t
+}
+
+const extensionsQuery = `SELECT name, default_version, installed_version, coalesce(comment, '') AS comment
+	FROM pg_available_extensions`
+
+func (s *ExtensionService) List(ctx context.Context, name string) (model.ExtensionsResponse, error) {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return model.ExtensionsResponse{}, err
+	}
+
+	var items []model.Extension
+	if err := queryJSON(s.Docker, item, extensionsQuery+" ORDER BY name", &items); err != nil {
+		return model.ExtensionsResponse{}, fmt.Errorf("list extensions: %w", err)
+	}
+
+	return model.ExtensionsResponse{Name: name, Items: items}, nil
+}
+
+// Create installs an extension that the database's image ships. Only names
+// listed in pg_available_extensions are accepted.
+func (s *ExtensionService) Create(ctx context.Context, name string, req model.CreateExtensionRequest) (model.Extension, error) {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return model.Extension{}, err
+	}
+
+	ext := strings.TrimSpace(req.Name)
+	if ext == "" {
+		return model.Extension{}, invalidField("name", "extension name is required")
+	}
+
+	var available []model.Extension
+	if err := queryJSON(s.Docker, item, extensionsQuery+" WHERE name = "+quoteLiteral(ext), &available); err != nil {
+		return model.Extension{}, fmt.Errorf("look up extension: %w", err)
+	}
+	if len(available) == 0 {
+		hint := ""
+		if item.Flavor == "" {
+			hint = " (deploy with a flavor that bundles it)"
+		}
+		return model.Extension{}, invalidField("name", "extension '%s' is not available in this image%s", ext, hint)
+	}
+
+	stmt := "CREATE EXTENSION IF NOT EXISTS " + quoteIdent(ext)
+	if schema := strings.TrimSpace(req.Schema); schema != "" {
+		stmt += " SCHEMA " + quoteIdent(schema)
+	}
+	stmt += " CASCADE"
+	if _, err := execSQL(s.Docker, item, stmt); err != nil {
+		return model.Extension{}, sqlInputError(fmt.Errorf("create extension '%s': %w", ext, err), nil)
+	}
+
+	var installed []model.Extension
+	if err := queryJSON(s.Docker, item, extensionsQuery+" WHERE name = "+quoteLiteral(ext), &installed); err != nil {
+		return model.Extension{}, fmt.Errorf("look up extension: %w", err)
+	}
+	if len(installed) == 0 {
+		return model.Extension{}, fmt.Errorf("extension '%s' disappeared after install", ext)
+	}
+	return installed[0], nil
+}
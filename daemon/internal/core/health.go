@@ -0,0 +1,54 @@
+package core
+
+import (
+	"fmt"
+	"os"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+)
+
+// HealthChecker answers readiness probes. The checks take no registry lock,
+// so a long deploy does not make the daemon look unready.
+type HealthChecker struct {
+	DataDir      string
+	RegistryPath string
+	Docker       *docker.Client
+}
+
+func (h *HealthChecker) Ready() model.HealthResponse {
+	checks := []model.HealthCheck{
+		healthCheck("docker", h.Docker.EnsureAvailable),
+		healthCheck("data_dir", h.checkDataDir),
+		healthCheck("registry", func() error {
+			_, err := registry.Load(h.RegistryPath)
+			return err
+		}),
+	}
+
+	status := "ok"
+	for _, c := range checks {
+		if !c.OK {
+			status = "unavailable"
+		}
+	}
+	return model.HealthResponse{Status: status, Checks: checks}
+}
+
+func (h *HealthChecker) checkDataDir() error {
+	f, err := os.CreateTemp(h.DataDir, ".healthz-*")
+	if err != nil {
+		return fmt.Errorf("data dir not writable: %w", err)
+	}
+	name := f.Name()
+	_ = f.Close()
+	return os.Remove(name)
+}
+
+func healthCheck(name string, fn func() error) model.HealthCheck {
+	if err := fn(); err != nil {
+		return model.HealthCheck{Name: name, OK: false, Error: err.Error()}
+	}
+	return model.HealthCheck{Name: name, OK: true}
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+
+	"pgdb/daemon/internal/model"
+)
+
+// These values end up in POSTGRES_INITDB_ARGS, which the image's entrypoint
+// word-splits, so they are restricted to shell-safe characters.
+var (
+	encodingRe = regexp.MustCompile(`^[A-Za-z0-9_]{1,32}$`)
+	localeRe   = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+)
+
+// normalizeInitdb validates initdb options for a major version and returns
+// them in canonical form, or nil when nothing was requested.
+func normalizeInitdb(opts *model.InitdbOptions, version int) (*model.InitdbOptions, error) {
+	if opts == nil {
+		return nil, nil
+	}
+
+	out := model.InitdbOptions{
+		Encoding:       strings.ToUpper(strings.TrimSpace(opts.Encoding)),
+		Locale:         strings.TrimSpace(opts.Locale),
+		LocaleProvider: strings.ToLower(strings.TrimSpace(opts.LocaleProvider)),
+		ICULocale:      strings.TrimSpace(opts.ICULocale),
+		DataChecksums:  opts.DataChecksums,
+	}
+	// libc is the only provider before 15, whose initdb has no
+	// --locale-provider flag.
+	if out.LocaleProvider == "libc" && version < 15 {
+		out.LocaleProvider = ""
+	}
+	if out == (model.InitdbOptions{}) {
+		return nil, nil
+	}
+
+	if out.Encoding != "" && !encodingRe.MatchString(out.Encoding) {
+		return nil, invalidField("initdb.encoding", "invalid initdb encoding '%s'", opts.Encoding)
+	}
+	if out.Locale != "" && !localeRe.MatchString(out.Locale) {
+		return nil, invalidField("initdb.locale", "invalid initdb locale '%s'", opts.Locale)
+	}
+
+	switch out.LocaleProvider {
+	case "", "libc":
+		if out.ICULocale != "" {
+			return nil, invalidField("initdb.icu_locale", "initdb icu_locale requires locale_provider 'icu'")
+		}
+	case "icu":
+		if version < 15 {
+			return nil, invalidField("initdb.locale_provider", "initdb locale_provider 'icu' requires version 15 or newer")
+		}
+		if out.ICULocale == "" {
+			return nil, invalidField("initdb.icu_locale", "initdb locale_provider 'icu' requires icu_locale")
+		}
+		if !localeRe.MatchString(out.ICULocale) {
+			return nil, invalidField("initdb.icu_locale", "invalid initdb icu_locale '%s'", opts.ICULocale)
+		}
+	default:
+		return nil, invalidField("initdb.locale_provider", "initdb locale_provider must be 'libc' or 'icu'")
+	}
+
+	return &out, nil
+}
+
+func initdbArgs(opts *model.InitdbOptions) string {
+	if opts == nil {
+		return ""
+	}
+
+	var args []string
+	if opts.Encoding != "" {
+		args = append(args, "--encoding="+opts.Encoding)
+	}
+	if opts.Locale != "" {
+		args = append(args, "--locale="+opts.Locale)
+	}
+	if opts.LocaleProvider != "" {
+		args = append(args, "--locale-provider="+opts.LocaleProvider)
+	}
+	if opts.ICULocale != "" {
+		args = append(args, "--icu-locale="+opts.ICULocale)
+	}
+	if opts.DataChecksums {
+		args = append(args, "--data-checksums")
+	}
+	return strings.Join(args, " ")
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+)
+
+const minTTL = time.Minute
+
+// LeaseService extends the lease of ephemeral databases and destroys them
+// once it runs out.
+type LeaseService struct {
+	RegistryPath string
+	LockPath     string
+	Destroyer    *Destroyer
+	Logger       *slog.Logger
+}
+
+func parseTTL(raw string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(strings.TrimSpace(raw))
+	if err != nil || ttl < minTTL {
+		return 0, invalidField("ttl", "invalid ttl '%s' (must be a duration of at least %s)", raw, minTTL)
+	}
+	return ttl, nil
+}
+
+func leaseExpired(item model.DBInstance, now time.Time) bool {
+	if item.ExpiresAt == "" {
+		return false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, item.ExpiresAt)
+	return err == nil && !expiresAt.After(now)
+}
+
+// Renew moves the expiry of an ephemeral database to now plus the given
+// TTL, or plus its deploy-time TTL if none is given.
+func (s *LeaseService) Renew(ctx context.Context, name string, req model.LeaseRequest) (model.LeaseResponse, error) {
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.LeaseResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.LeaseResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.LeaseResponse{}, databaseNotFound(name)
+	}
+	if item.ExpiresAt == "" {
+		return model.LeaseResponse{}, conflict("database '%s' was deployed without a ttl", name)
+	}
+
+	raw := req.TTL
+	if strings.TrimSpace(raw) == "" {
+		raw = item.TTL
+	}
+	ttl, err := parseTTL(raw)
+	if err != nil {
+		return model.LeaseResponse{}, err
+	}
+
+	item.ExpiresAt = time.Now().UTC().Add(ttl).Format(time.RFC3339)
+	r.Items[idx] = item
+	if err := registry.Save(s.RegistryPath, r); err != nil {
+		return model.LeaseResponse{}, err
+	}
+
+	return model.LeaseResponse{Name: name, ExpiresAt: item.ExpiresAt}, nil
+}
+
+func (s *LeaseService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reapExpired(ctx, time.Now().UTC())
+		}
+	}
+}
+
+// reapExpired destroys databases whose lease has run out. The expiry is
+// checked again under the lock so a concurrent renewal wins.
+func (s *LeaseService) reapExpired(ctx context.Context, now time.Time) {
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		s.Logger.Error("lease reaper: load registry failed", "error", err)
+		return
+	}
+
+	for _, item := range r.Items {
+		if !leaseExpired(item, now) {
+			continue
+		}
+		destroyed, err := s.Destroyer.DestroyExpired(ctx, item.Name, now)
+		if err != nil {
+			s.Logger.Error("lease reaper: destroy failed", "name", item.Name, "expires_at", item.ExpiresAt, "error", err)
+			continue
+		}
+		if destroyed {
+			s.Logger.Info("lease reaper: destroyed expired database", "name", item.Name, "expires_at", item.ExpiresAt)
+		}
+	}
+}
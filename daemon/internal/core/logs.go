@@ -0,0 +1,522 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+)
+
+const (
+	defaultLogTail  = 100
+	maxLogTail      = 10000
+	logPollInterval = time.Second
+)
+
+// logSourceDocker marks entries read from the container output, for
+// databases that do not write structured log files.
+const logSourceDocker = "docker"
+
+// severityLevels orders severities for filtering. LOG ranks with INFO
+// rather than between ERROR and FATAL as in log_min_messages, so asking
+// for errors does not return routine checkpoint messages.
+var severityLevels = map[string]int{
+	"DEBUG": 0, "INFO": 1, "LOG": 1, "NOTICE": 2, "WARNING": 3, "ERROR": 4, "FATAL": 5, "PANIC": 6,
+}
+
+// dockerLogLineRe matches the default log_line_prefix ("%m [%p] ").
+var dockerLogLineRe = regexp.MustCompile(`^\S+ \S+ \S+ \[(\d+)\] ([A-Z0-9]+):\s+(.*)$`)
+
+// logParameters makes Postgres write structured log files: jsonlog on 15+,
+// csvlog before. Files are named after the hour and overwritten a day
+// later, so at most 24 hours are kept on the volume.
+func logParameters(version int) map[string]string {
+	destination := "jsonlog"
+	if version < 15 {
+		destination = "csvlog"
+	}
+	return map[string]string{
+		"logging_collector":        "on",
+		"log_destination":          destination,
+		"log_directory":            "log",
+		"log_filename":             "postgresql-%H",
+		"log_rotation_age":         "60",
+		"log_rotation_size":        "0",
+		"log_truncate_on_rotation": "on",
+		"log_timezone":             "UTC",
+	}
+}
+
+// logFormat returns the structured log destination the instance writes,
+// or "" if it only logs to the container output.
+func logFormat(item model.DBInstance) string {
+	if item.Parameters["logging_collector"] != "on" {
+		return ""
+	}
+	for _, format := range []string{"jsonlog", "csvlog"} {
+		if settingListHas(item.Parameters["log_destination"], format) {
+			return format
+		}
+	}
+	return ""
+}
+
+// LogService reads Postgres logs. Databases deployed with structured
+// logging are read from their log files, others and stopped containers
+// from the container output.
+type LogService struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+}
+
+func (s *LogService) traced(ctx context.Context) *LogService {
+	t := *s
+	t.Docker = s.Docker.WithContext(ctx)
+	return &t
+}
+
+type logFilter struct {
+	tail     int
+	since    time.Time
+	minLevel int
+}
+
+func parseLogFilter(req model.LogsRequest) (logFilter, error) {
+	f := logFilter{tail: req.Tail}
+	if f.tail < 0 {
+		f.tail = defaultLogTail
+	}
+	if f.tail > maxLogTail {
+		return logFilter{}, invalidField("tail", "tail must be at most %d", maxLogTail)
+	}
+
+	if since := strings.TrimSpace(req.Since); since != "" {
+		if t, err := time.Parse(time.RFC3339, since); err == nil {
+			f.since = t
+		} else if d, err := time.ParseDuration(since); err == nil && d > 0 {
+			f.since = time.Now().Add(-d)
+		} else {
+			return logFilter{}, invalidField("since", "invalid since '%s' (must be an RFC3339 time or a duration like 15m)", since)
+		}
+	}
+
+	if severity := strings.ToUpper(strings.TrimSpace(req.Severity)); severity != "" {
+		level, ok := severityLevels[severity]
+		if !ok {
+			return logFilter{}, invalidField("severity", "invalid severity '%s' (must be debug, info, log, notice, warning, error, fatal or panic)", req.Severity)
+		}
+		f.minLevel = level
+	}
+	return f, nil
+}
+
+func (f logFilter) match(e model.LogEntry) bool {
+	if severityLevel(e.Severity) < f.minLevel {
+		return false
+	}
+	if !f.since.IsZero() {
+		if t, err := time.Parse(time.RFC3339Nano, e.Time); err == nil && t.Before(f.since) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f logFilter) filter(entries []model.LogEntry) []model.LogEntry {
+	out := []model.LogEntry{}
+	for _, e := range entries {
+		if f.match(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// reachesSince reports whether entries, oldest first, start before since,
+// so that older entries cannot match.
+func (f logFilter) reachesSince(entries []model.LogEntry) bool {
+	if f.since.IsZero() || len(entries) == 0 {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339Nano, entries[0].Time)
+	return err == nil && t.Before(f.since)
+}
+
+func severityLevel(severity string) int {
+	if strings.HasPrefix(severity, "DEBUG") {
+		return 0
+	}
+	if level, ok := severityLevels[severity]; ok {
+		return level
+	}
+	return severityLevels["LOG"]
+}
+
+func (s *LogService) Read(ctx context.Context, name string, req model.LogsRequest) (model.LogsResponse, error) {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return model.LogsResponse{}, err
+	}
+	f, err := parseLogFilter(req)
+	if err != nil {
+		return model.LogsResponse{}, err
+	}
+
+	format, err := s.fileLogFormat(item)
+	if err != nil {
+		return model.LogsResponse{}, err
+	}
+	if format != "" {
+		entries, _, err := s.readLogFiles(item, format, f)
+		if err != nil {
+			return model.LogsResponse{}, err
+		}
+		return model.LogsResponse{Name: name, Source: format, Items: entries}, nil
+	}
+
+	entries := []model.LogEntry{}
+	err = s.readContainerLogs(ctx, item, f, false, func(e model.LogEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return model.LogsResponse{}, err
+	}
+	return model.LogsResponse{Name: name, Source: logSourceDocker, Items: entries}, nil
+}
+
+// Follow emits the last entries like Read, then new ones as they are
+// written, until ctx is done or emit fails. ready is called with the log
+// source once the request is validated, before any entry.
+func (s *LogService) Follow(ctx context.Context, name string, req model.LogsRequest, ready func(source string), emit func(model.LogEntry) error) error {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return err
+	}
+	f, err := parseLogFilter(req)
+	if err != nil {
+		return err
+	}
+
+	format, err := s.fileLogFormat(item)
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		ready(logSourceDocker)
+		return s.readContainerLogs(ctx, item, f, true, emit)
+	}
+	entries, cursor, err := s.readLogFiles(item, format, f)
+	if err != nil {
+		return err
+	}
+
+	ready(format)
+	for _, e := range entries {
+		if err := emit(e); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		entries, err := s.pollLogFile(item, format, cursor)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !f.match(e) {
+				continue
+			}
+			if err := emit(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// logCursor is the read position in the current log file. pending holds
+// the start of an entry that was not completely written yet.
+type logCursor struct {
+	file    string
+	offset  int64
+	pending []byte
+}
+
+// fileLogFormat returns the structured log format to read item's logs
+// from, or "" if they have to come from the container output: the instance
+// does not write log files, or its container is not running, so the files
+// cannot be read.
+func (s *LogService) fileLogFormat(item model.DBInstance) (string, error) {
+	format := logFormat(item)
+	if format == "" {
+		return "", nil
+	}
+	containers, err := s.Docker.ListContainers("pgdb-" + item.Name)
+	if err != nil {
+		return "", err
+	}
+	for _, ct := range containers {
+		if ct.ID == item.ContainerID && ct.State == "running" {
+			return format, nil
+		}
+	}
+	return "", nil
+}
+
+// readLogFiles returns the last entries matching f, oldest first, and a
+// cursor at the end of the current log file. Files are read newest first,
+// one per exec, and only until tail entries are found or since is passed,
+// so a short tail does not load the whole day of logs.
+func (s *LogService) readLogFiles(item model.DBInstance, format string, f logFilter) ([]model.LogEntry, *logCursor, error) {
+	current, err := s.currentLogFile(item, format)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s files: %w", format, err)
+	}
+	cursor := &logCursor{file: current}
+	entries, err := s.pollLogFile(item, format, cursor)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s files: %w", format, err)
+	}
+	matched := f.filter(entries)
+
+	if len(matched) < f.tail && !f.reachesSince(entries) {
+		listing, err := s.Docker.Exec(item.ContainerID, "sh", "-c", `cd "$PGDATA" && ls -t -- "$1"`, "sh", path.Dir(current))
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s files: %w", format, err)
+		}
+		for _, file := range strings.Fields(string(listing)) {
+			file = path.Join(path.Dir(current), file)
+			if path.Ext(file) != path.Ext(current) || file == current {
+				continue
+			}
+			data, err := s.readLogFrom(item, file, 0)
+			if err != nil {
+				return nil, nil, fmt.Errorf("read %s files: %w", format, err)
+			}
+			entries := parseLogData(data, format)
+			matched = append(f.filter(entries), matched...)
+			if len(matched) >= f.tail || f.reachesSince(entries) {
+				break
+			}
+		}
+	}
+
+	if len(matched) > f.tail {
+		matched = matched[len(matched)-f.tail:]
+	}
+	return matched, cursor, nil
+}
+
+// pollLogFile returns the entries written since the cursor. When Postgres
+// has moved on to the next hour's file, the rest of the previous file is
+// read first.
+func (s *LogService) pollLogFile(item model.DBInstance, format string, c *logCursor) ([]model.LogEntry, error) {
+	current, err := s.currentLogFile(item, format)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []model.LogEntry
+	if current != c.file {
+		rest, err := s.readLogFrom(item, c.file, c.offset)
+		if err != nil {
+			return nil, err
+		}
+		entries = parseLogData(append(c.pending, rest...), format)
+		*c = logCursor{file: current}
+	}
+
+	data, err := s.readLogFrom(item, c.file, c.offset)
+	if err != nil {
+		return nil, err
+	}
+	c.offset += int64(len(data))
+	buf := append(c.pending, data...)
+	n := completeEntries(buf, format)
+	entries = append(entries, parseLogData(buf[:n], format)...)
+	c.pending = append([]byte(nil), buf[n:]...)
+	return entries, nil
+}
+
+// currentLogFile reads the file Postgres writes to from current_logfiles,
+// relative to the data directory.
+func (s *LogService) currentLogFile(item model.DBInstance, format string) (string, error) {
+	out, err := s.Docker.Exec(item.ContainerID, "sh", "-c", `cat "$PGDATA/current_logfiles"`)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if dest, file, ok := strings.Cut(strings.TrimSpace(line), " "); ok && dest == format {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("postgres is not writing %s files", format)
+}
+
+func (s *LogService) readLogFrom(item model.DBInstance, file string, offset int64) ([]byte, error) {
+	return s.Docker.Exec(item.ContainerID, "sh", "-c", `tail -c +"$1" -- "$PGDATA/$2"`, "sh", strconv.FormatInt(offset+1, 10), file)
+}
+
+// completeEntries returns the length of the prefix of data made of whole
+// entries. CSV entries can contain newlines inside quoted fields.
+func completeEntries(data []byte, format string) int {
+	if format != "csvlog" {
+		return bytes.LastIndexByte(data, '\n') + 1
+	}
+	end, quoted := 0, false
+	for i, b := range data {
+		switch {
+		case b == '"':
+			quoted = !quoted
+		case b == '\n' && !quoted:
+			end = i + 1
+		}
+	}
+	return end
+}
+
+func parseLogData(data []byte, format string) []model.LogEntry {
+	if format == "csvlog" {
+		return parseCSVLog(data)
+	}
+	return parseJSONLog(data)
+}
+
+func parseJSONLog(data []byte) []model.LogEntry {
+	var entries []model.LogEntry
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var row struct {
+			Timestamp       string `json:"timestamp"`
+			User            string `json:"user"`
+			Database        string `json:"dbname"`
+			PID             int    `json:"pid"`
+			Severity        string `json:"error_severity"`
+			SQLState        string `json:"state_code"`
+			Message         string `json:"message"`
+			Detail          string `json:"detail"`
+			Hint            string `json:"hint"`
+			Context         string `json:"context"`
+			Statement       string `json:"statement"`
+			ApplicationName string `json:"application_name"`
+		}
+		if err := json.Unmarshal(line, &row); err != nil {
+			continue
+		}
+		entries = append(entries, model.LogEntry{
+			Time:            logTime(row.Timestamp),
+			Severity:        row.Severity,
+			Message:         row.Message,
+			Detail:          row.Detail,
+			Hint:            row.Hint,
+			Context:         row.Context,
+			Statement:       row.Statement,
+			SQLState:        row.SQLState,
+			User:            row.User,
+			Database:        row.Database,
+			PID:             row.PID,
+			ApplicationName: row.ApplicationName,
+		})
+	}
+	return entries
+}
+
+// parseCSVLog reads csvlog rows; the columns used here have kept their
+// positions in every supported version.
+func parseCSVLog(data []byte) []model.LogEntry {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	var entries []model.LogEntry
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil || len(row) < 23 {
+			continue
+		}
+		pid, _ := strconv.Atoi(row[3])
+		entries = append(entries, model.LogEntry{
+			Time:            logTime(row[0]),
+			User:            row[1],
+			Database:        row[2],
+			PID:             pid,
+			Severity:        row[11],
+			SQLState:        row[12],
+			Message:         row[13],
+			Detail:          row[14],
+			Hint:            row[15],
+			Context:         row[18],
+			Statement:       row[19],
+			ApplicationName: row[22],
+		})
+	}
+	return entries
+}
+
+// logTime converts a Postgres log timestamp to RFC3339 in UTC. It is
+// returned unchanged if it cannot be parsed.
+func logTime(value string) string {
+	t, err := time.Parse("2006-01-02 15:04:05.999 MST", value)
+	if err != nil {
+		return value
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// readContainerLogs emits the container output as entries. Severity and
+// PID are only known for lines in the default log format, and tail counts
+// lines before the severity filter.
+func (s *LogService) readContainerLogs(ctx context.Context, item model.DBInstance, f logFilter, follow bool, emit func(model.LogEntry) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := s.Docker.Logs(ctx, item.ContainerID, f.tail, f.since, follow)
+	defer out.Close()
+
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		ts, line, _ := strings.Cut(scanner.Text(), " ")
+		e := model.LogEntry{Time: ts, Message: line}
+		if m := dockerLogLineRe.FindStringSubmatch(line); m != nil {
+			e.PID, _ = strconv.Atoi(m[1])
+			e.Severity = m[2]
+			e.Message = m[3]
+		}
+		if !f.match(e) {
+			continue
+		}
+		if err := emit(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,285 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+)
+
+const (
+	MaskNull      = "null"
+	MaskHash      = "hash"
+	MaskFakeEmail = "fake_email"
+	MaskKeep      = "keep"
+)
+
+// minDigestLength is the fewest hex digits of the SHA-256 digest a hashed
+// or fake_email value keeps. Shorter digests would collide often enough to
+// break unique constraints in clones.
+const minDigestLength = 16
+
+const (
+	fakeEmailPrefix = "user_"
+	fakeEmailDomain = "@example.invalid"
+)
+
+var textUDTs = map[string]bool{"text": true, "varchar": true, "bpchar": true, "citext": true}
+
+type MaskingService struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+}
+
+func (s *MaskingService) traced(ctx context.Context) *MaskingService {
+	t := *s
+	t.Docker = s.Docker.WithContext(ctx)
+	return &t
+}
+
+type columnInfo struct {
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	Column    string `json:"column"`
+	UDTName   string `json:"udt_name"`
+	Nullable  bool   `json:"nullable"`
+	MaxLength *int   `json:"max_length"`
+}
+
+func (s *MaskingService) Get(ctx context.Context, name string) (model.MaskingResponse, error) {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.MaskingResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.MaskingResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.MaskingResponse{}, databaseNotFound(name)
+	}
+
+	columns, err := loadColumns(s.Docker, item)
+	if err != nil {
+		return model.MaskingResponse{}, err
+	}
+
+	return maskingResponse(item, validateMaskRules(item.MaskRules, columns)), nil
+}
+
+func (s *MaskingService) Set(ctx context.Context, name string, rules []model.MaskRule) (model.MaskingResponse, error) {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.MaskingResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.MaskingResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.MaskingResponse{}, databaseNotFound(name)
+	}
+
+	columns, err := loadColumns(s.Docker, item)
+	if err != nil {
+		return model.MaskingResponse{}, err
+	}
+
+	normalized := normalizeMaskRules(rules)
+	if issues := validateMaskRules(normalized, columns); len(issues) > 0 {
+		return model.MaskingResponse{}, maskIssuesError(issues)
+	}
+
+	item.MaskRules = normalized
+	r.Items[idx] = item
+	if err := registry.Save(s.RegistryPath, r); err != nil {
+		return model.MaskingResponse{}, err
+	}
+
+	return maskingResponse(item, []model.MaskIssue{}), nil
+}
+
+func maskingResponse(item model.DBInstance, issues []model.MaskIssue) model.MaskingResponse {
+	rules := item.MaskRules
+	if rules == nil {
+		rules = []model.MaskRule{}
+	}
+	return model.MaskingResponse{Name: item.Name, Rules: rules, Issues: issues}
+}
+
+func loadColumns(d *docker.Client, item model.DBInstance) ([]columnInfo, error) {
+	const query = `SELECT c.table_schema AS "schema", c.table_name AS "table", c.column_name AS "column",
+		c.udt_name, c.is_nullable = 'YES' AS nullable, c.character_maximum_length AS max_length
+		FROM information_schema.columns c
+		JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+		WHERE t.table_type = 'BASE TABLE' AND c.table_schema NOT IN ('pg_catalog', 'information_schema')`
+
+	var columns []columnInfo
+	if err := queryJSON(d, item, query, &columns); err != nil {
+		return nil, fmt.Errorf("load source schema: %w", err)
+	}
+	return columns, nil
+}
+
+func normalizeMaskRules(rules []model.MaskRule) []model.MaskRule {
+	out := make([]model.MaskRule, 0, len(rules))
+	for _, rule := range rules {
+		table := strings.TrimSpace(rule.Table)
+		if table != "" && !strings.Contains(table, ".") {
+			table = "public." + table
+		}
+		out = append(out, model.MaskRule{
+			Table:  table,
+			Column: strings.TrimSpace(rule.Column),
+			Action: strings.ToLower(strings.TrimSpace(rule.Action)),
+		})
+	}
+	return out
+}
+
+// validateMaskRules checks each rule against the live schema so that rules
+// pointing at renamed or dropped columns are flagged instead of silently
+// leaving data unmasked.
+func validateMaskRules(rules []model.MaskRule, columns []columnInfo) []model.MaskIssue {
+	byColumn := make(map[string]columnInfo, len(columns))
+	tables := make(map[string]bool)
+	for _, col := range columns {
+		table := col.Schema + "." + col.Table
+		byColumn[table+"."+col.Column] = col
+		tables[table] = true
+	}
+
+	issues := []model.MaskIssue{}
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		issue := func(problem string) {
+			issues = append(issues, model.MaskIssue{Table: rule.Table, Column: rule.Column, Problem: problem})
+		}
+
+		switch rule.Action {
+		case MaskNull, MaskHash, MaskFakeEmail, MaskKeep:
+		default:
+			issue(fmt.Sprintf("unknown action '%s' (must be one of null, hash, fake_email, keep)", rule.Action))
+			continue
+		}
+
+		key := rule.Table + "." + rule.Column
+		if seen[key] {
+			issue("duplicate rule for column")
+			continue
+		}
+		seen[key] = true
+
+		col, ok := byColumn[key]
+		if !ok {
+			if tables[rule.Table] {
+				issue("column not found in source table (renamed or dropped?)")
+			} else {
+				issue("table not found in source schema (renamed or dropped?)")
+			}
+			continue
+		}
+
+		switch rule.Action {
+		case MaskNull:
+			if !col.Nullable {
+				issue("column is NOT NULL and cannot be nulled out")
+			}
+		case MaskHash, MaskFakeEmail:
+			if !textUDTs[col.UDTName] {
+				issue(fmt.Sprintf("action requires a text column, got %s", col.UDTName))
+			} else if n := maskedLength(rule.Action); col.MaxLength != nil && *col.MaxLength < n {
+				issue(fmt.Sprintf("column holds %d characters, action needs at least %d", *col.MaxLength, n))
+			}
+		}
+	}
+
+	return issues
+}
+
+// maskedLength is the shortest column that holds a masked value with a
+// digest of minDigestLength.
+func maskedLength(action string) int {
+	if action == MaskFakeEmail {
+		return len(fakeEmailPrefix) + minDigestLength + len(fakeEmailDomain)
+	}
+	return minDigestLength
+}
+
+func maskIssuesError(issues []model.MaskIssue) error {
+	parts := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		parts = append(parts, fmt.Sprintf("%s.%s: %s", issue.Table, issue.Column, issue.Problem))
+	}
+	return newError(CodeValidation, map[string]any{"issues": issues}, "masking rules do not match source schema: %s", strings.Join(parts, "; "))
+}
+
+// applyMasking rewrites the masked columns of a freshly restored clone in a
+// single transaction.
+func applyMasking(d *docker.Client, item model.DBInstance, rules []model.MaskRule, columns []columnInfo) error {
+	byColumn := make(map[string]columnInfo, len(columns))
+	for _, col := range columns {
+		byColumn[col.Schema+"."+col.Table+"."+col.Column] = col
+	}
+
+	statements := []string{}
+	for _, rule := range rules {
+		col, ok := byColumn[rule.Table+"."+rule.Column]
+		if !ok {
+			return invalid("masking rule %s.%s does not match source schema", rule.Table, rule.Column)
+		}
+		if stmt := maskStatement(rule, col); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	if len(statements) == 0 {
+		return nil
+	}
+
+	sql := "BEGIN; " + strings.Join(statements, "; ") + "; COMMIT;"
+	if _, err := execSQL(d, item, sql); err != nil {
+		return sqlInputError(fmt.Errorf("apply masking rules: %w", err), nil)
+	}
+	return nil
+}
+
+func maskStatement(rule model.MaskRule, col columnInfo) string {
+	table := quoteIdent(col.Schema) + "." + quoteIdent(col.Table)
+	column := quoteIdent(col.Column)
+	digest := fmt.Sprintf("encode(sha256(convert_to(%s::text, 'UTF8')), 'hex')", column)
+
+	var expr string
+	switch rule.Action {
+	case MaskNull:
+		return fmt.Sprintf("UPDATE %s SET %s = NULL", table, column)
+	case MaskHash:
+		// validateMaskRules made sure the column keeps at least
+		// minDigestLength digits.
+		expr = digest
+		if col.MaxLength != nil && *col.MaxLength < 64 {
+			expr = fmt.Sprintf("left(%s, %d)", expr, *col.MaxLength)
+		}
+	case MaskFakeEmail:
+		expr = fmt.Sprintf("%s || left(%s, %d) || %s", quoteLiteral(fakeEmailPrefix), digest, minDigestLength, quoteLiteral(fakeEmailDomain))
+	default:
+		return ""
+	}
+
+	return fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IS NOT NULL", table, column, expr, column)
+}
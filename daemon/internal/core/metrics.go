@@ -0,0 +1,240 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/metrics"
+	"pgdb/daemon/internal/model"
+)
+
+// metricsParallelism bounds how many databases are queried at once per
+// scrape.
+const metricsParallelism = 8
+
+// MetricsCollector writes the daemon's metrics plus per-database metrics
+// gathered from docker and from each database. Gathering them takes a
+// docker call per database, so Run does it in the background and scrapes
+// are served the latest result.
+type MetricsCollector struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+	Logger       *slog.Logger
+
+	mu     sync.Mutex
+	cached []byte
+}
+
+type databaseStats struct {
+	SizeBytes      float64 `json:"size_bytes"`
+	Connections    float64 `json:"connections"`
+	Commits        float64 `json:"commits"`
+	Rollbacks      float64 `json:"rollbacks"`
+	BlocksHit      float64 `json:"blocks_hit"`
+	BlocksRead     float64 `json:"blocks_read"`
+	ReplicationLag float64 `json:"replication_lag_seconds"`
+}
+
+const databaseStatsQuery = `SELECT pg_database_size(d.datname) AS size_bytes,
+	(SELECT count(*) FROM pg_stat_activity a WHERE a.datname = d.datname) AS connections,
+	d.xact_commit AS commits, d.xact_rollback AS rollbacks, d.blks_hit AS blocks_hit, d.blks_read AS blocks_read,
+	(SELECT coalesce(max(extract(epoch FROM replay_lag)), 0) FROM pg_stat_replication) AS replication_lag_seconds
+	FROM pg_stat_database d WHERE d.datname = current_database()`
+
+func (c *MetricsCollector) Write(w io.Writer) {
+	metrics.WriteDaemon(w)
+
+	c.mu.Lock()
+	cached := c.cached
+	c.mu.Unlock()
+	_, _ = w.Write(cached)
+}
+
+// Run gathers the per-database metrics now and at every tick.
+func (c *MetricsCollector) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.collect(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *MetricsCollector) collect(ctx context.Context) {
+	var buf bytes.Buffer
+	c.writeCollected(ctx, &buf)
+	metrics.WriteHeader(&buf, "pgdbd_metrics_collected_timestamp_seconds", "When the per-database metrics were last gathered.", "gauge")
+	metrics.WriteSample(&buf, "pgdbd_metrics_collected_timestamp_seconds", float64(time.Now().Unix()))
+
+	c.mu.Lock()
+	c.cached = buf.Bytes()
+	c.mu.Unlock()
+}
+
+func (c *MetricsCollector) writeCollected(ctx context.Context, w io.Writer) {
+	r, err := loadRegistry(ctx, c.RegistryPath, c.LockPath)
+	if err != nil {
+		c.Logger.Error("metrics: load registry failed", "error", err)
+		return
+	}
+
+	containers, err := c.Docker.ListContainers("pgdb-")
+	if err != nil {
+		c.Logger.Error("metrics: list containers failed", "error", err)
+		return
+	}
+	c.writeDrift(w, r, containers)
+
+	running := []string{}
+	for _, ct := range containers {
+		if ct.State == "running" {
+			running = append(running, ct.ID)
+		}
+	}
+	stats, err := c.Docker.Stats(running)
+	if err != nil {
+		c.Logger.Error("metrics: container stats failed", "error", err)
+		stats = map[string]docker.ContainerStats{}
+	}
+
+	metrics.WriteHeader(w, "pgdb_container_cpu_percent", "CPU usage of the database container, in percent of one core.", "gauge")
+	for _, item := range r.Items {
+		if s, ok := stats[item.ContainerID]; ok {
+			metrics.WriteSample(w, "pgdb_container_cpu_percent", s.CPUPercent, "name", item.Name)
+		}
+	}
+	metrics.WriteHeader(w, "pgdb_container_memory_bytes", "Memory used by the database container.", "gauge")
+	for _, item := range r.Items {
+		if s, ok := stats[item.ContainerID]; ok {
+			metrics.WriteSample(w, "pgdb_container_memory_bytes", s.MemoryBytes, "name", item.Name)
+		}
+	}
+
+	c.writeDatabaseStats(w, r.Items, stats)
+}
+
+func (c *MetricsCollector) writeDrift(w io.Writer, r model.Registry, containers []docker.Container) {
+	counts := driftCounts(r, containers)
+	metrics.WriteHeader(w, "pgdbd_reconciler_drift", "Registry entries and containers that disagree, by kind.", "gauge")
+	for _, kind := range driftKinds {
+		metrics.WriteSample(w, "pgdbd_reconciler_drift", float64(counts[kind]), "kind", kind)
+	}
+}
+
+var driftKinds = []string{"missing_container", "not_running", "orphaned_container"}
+
+// driftCounts counts differences between the registry and docker:
+// registered databases whose container is gone or not running, and pgdb
+// containers nothing in the registry refers to.
+func driftCounts(r model.Registry, containers []docker.Container) map[string]int {
+	byID := make(map[string]docker.Container, len(containers))
+	for _, ct := range containers {
+		byID[ct.ID] = ct
+	}
+
+	counts := map[string]int{}
+	known := map[string]bool{}
+	for _, item := range append(append([]model.DBInstance{}, r.Items...), r.Pool...) {
+		known[item.ContainerID] = true
+		ct, ok := byID[item.ContainerID]
+		switch {
+		case !ok:
+			counts["missing_container"]++
+		case ct.State != "running":
+			counts["not_running"]++
+		}
+	}
+	for _, ct := range containers {
+		if !known[ct.ID] && !strings.HasSuffix(ct.Name, "-upgrade") {
+			counts["orphaned_container"]++
+		}
+	}
+	return counts
+}
+
+func (c *MetricsCollector) writeDatabaseStats(w io.Writer, items []model.DBInstance, running map[string]docker.ContainerStats) {
+	results := make([]*databaseStats, len(items))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, metricsParallelism)
+	for i, item := range items {
+		if _, ok := running[item.ContainerID]; !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, item model.DBInstance) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var rows []databaseStats
+			if err := queryJSON(c.Docker, item, databaseStatsQuery, &rows); err != nil || len(rows) == 0 {
+				c.Logger.Warn("metrics: query database stats failed", "name", item.Name, "error", err)
+				return
+			}
+			results[i] = &rows[0]
+		}(i, item)
+	}
+	wg.Wait()
+
+	families := []struct {
+		name, help, typ string
+		value           func(s *databaseStats) []float64
+		labels          []string
+	}{
+		{"pgdb_up", "Whether the database answered the metrics query.", "gauge", nil, nil},
+		{"pgdb_database_size_bytes", "Size of the database.", "gauge",
+			func(s *databaseStats) []float64 { return []float64{s.SizeBytes} }, nil},
+		{"pgdb_database_connections", "Open connections to the database.", "gauge",
+			func(s *databaseStats) []float64 { return []float64{s.Connections} }, nil},
+		{"pgdb_database_transactions_total", "Transactions since the statistics were reset, by result.", "counter",
+			func(s *databaseStats) []float64 { return []float64{s.Commits, s.Rollbacks} }, []string{"commit", "rollback"}},
+		{"pgdb_database_cache_hit_ratio", "Share of block reads served from shared buffers.", "gauge",
+			func(s *databaseStats) []float64 { return []float64{cacheHitRatio(s)} }, nil},
+		{"pgdb_database_replication_lag_seconds", "Largest replay lag of any streaming replica.", "gauge",
+			func(s *databaseStats) []float64 { return []float64{s.ReplicationLag} }, nil},
+	}
+	for _, f := range families {
+		metrics.WriteHeader(w, f.name, f.help, f.typ)
+		for i, item := range items {
+			s := results[i]
+			if f.value == nil {
+				up := 0.0
+				if s != nil {
+					up = 1
+				}
+				metrics.WriteSample(w, f.name, up, "name", item.Name)
+				continue
+			}
+			if s == nil {
+				continue
+			}
+			for j, v := range f.value(s) {
+				if f.labels != nil {
+					metrics.WriteSample(w, f.name, v, "name", item.Name, "result", f.labels[j])
+				} else {
+					metrics.WriteSample(w, f.name, v, "name", item.Name)
+				}
+			}
+		}
+	}
+}
+
+func cacheHitRatio(s *databaseStats) float64 {
+	total := s.BlocksHit + s.BlocksRead
+	if total == 0 {
+		return 1
+	}
+	return s.BlocksHit / total
+}
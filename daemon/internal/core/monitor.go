@@ -0,0 +1,166 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/events"
+	"pgdb/daemon/internal/model"
+)
+
+// Health states reported by the monitor.
+const (
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+	HealthStopped   = "stopped"
+	HealthMissing   = "missing"
+)
+
+// Monitor watches the containers of registered databases and publishes an
+// event when a database's health changes, when its volume fills past
+// DiskThreshold percent, or when the registry and docker start or stop
+// disagreeing. States are kept in memory, so the first pass after a start
+// only records them.
+type Monitor struct {
+	RegistryPath  string
+	LockPath      string
+	Docker        *docker.Client
+	Events        *events.Log
+	Logger        *slog.Logger
+	DiskThreshold int
+
+	health   map[string]string
+	diskHigh map[string]bool
+	drift    map[string]int
+}
+
+func (m *Monitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Monitor) check(ctx context.Context) {
+	r, err := loadRegistry(ctx, m.RegistryPath, m.LockPath)
+	if err != nil {
+		m.Logger.Error("monitor: load registry failed", "error", err)
+		return
+	}
+	containers, err := m.Docker.ListContainers("pgdb-")
+	if err != nil {
+		m.Logger.Error("monitor: list containers failed", "error", err)
+		return
+	}
+
+	states := make(map[string]string, len(containers))
+	for _, ct := range containers {
+		states[ct.ID] = ct.State
+	}
+
+	health := make(map[string]string, len(r.Items))
+	for _, item := range r.Items {
+		health[item.Name] = m.probe(item, states)
+	}
+	if m.health != nil {
+		for name, state := range health {
+			if previous, ok := m.health[name]; ok && previous != state {
+				m.Logger.Warn("database health changed", "name", name, "from", previous, "to", state)
+				m.Events.Publish(events.HealthChanged, name, map[string]any{"from": previous, "to": state})
+			}
+		}
+	}
+	first := m.diskHigh == nil
+	diskHigh := make(map[string]bool, len(r.Items))
+	for _, item := range r.Items {
+		if health[item.Name] != HealthHealthy {
+			diskHigh[item.Name] = m.diskHigh[item.Name]
+			continue
+		}
+		used, size, err := volumeUsage(m.Docker, item)
+		if err != nil {
+			m.Logger.Warn("monitor: disk usage failed", "name", item.Name, "error", err)
+			diskHigh[item.Name] = m.diskHigh[item.Name]
+			continue
+		}
+		percent := 100 * float64(used) / float64(size)
+		diskHigh[item.Name] = percent >= float64(m.DiskThreshold)
+		if diskHigh[item.Name] && !m.diskHigh[item.Name] && !first {
+			m.Logger.Warn("database disk above threshold", "name", item.Name, "used_percent", percent)
+			m.Events.Publish(events.DiskHigh, item.Name, map[string]any{
+				"used_bytes":        used,
+				"size_bytes":        size,
+				"used_percent":      percent,
+				"threshold_percent": m.DiskThreshold,
+			})
+		}
+	}
+	m.health = health
+	m.diskHigh = diskHigh
+
+	drift := driftCounts(r, containers)
+	if m.drift != nil && !sameCounts(m.drift, drift) {
+		data := make(map[string]any, len(driftKinds))
+		for _, kind := range driftKinds {
+			data[kind] = drift[kind]
+		}
+		m.Events.Publish(events.Drift, "", data)
+	}
+	m.drift = drift
+}
+
+// probe reports a database as healthy when its container runs and
+// Postgres answers a query.
+func (m *Monitor) probe(item model.DBInstance, states map[string]string) string {
+	state, ok := states[item.ContainerID]
+	switch {
+	case !ok:
+		return HealthMissing
+	case state != "running":
+		return HealthStopped
+	}
+	if _, err := execSQL(m.Docker, item, "SELECT 1"); err != nil {
+		return HealthUnhealthy
+	}
+	return HealthHealthy
+}
+
+// volumeUsage reports the used and total bytes of the filesystem holding
+// the data directory.
+func volumeUsage(d *docker.Client, item model.DBInstance) (int64, int64, error) {
+	out, err := d.Exec(item.ContainerID, "sh", "-c", `df -P -k "$PGDATA" | tail -n 1`)
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 4 {
+		return 0, 0, fmt.Errorf("unexpected df output '%s'", strings.TrimSpace(string(out)))
+	}
+	used, err1 := strconv.ParseInt(fields[2], 10, 64)
+	avail, err2 := strconv.ParseInt(fields[3], 10, 64)
+	if err1 != nil || err2 != nil || used+avail == 0 {
+		return 0, 0, fmt.Errorf("unexpected df output '%s'", strings.TrimSpace(string(out)))
+	}
+	return used * 1024, (used + avail) * 1024, nil
+}
+
+func sameCounts(a, b map[string]int) bool {
+	for _, kind := range driftKinds {
+		if a[kind] != b[kind] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,305 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/events"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+)
+
+var parameterNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_.]*$`)
+
+const (
+	reloadTimeout      = 5 * time.Second
+	reloadPollInterval = 50 * time.Millisecond
+)
+
+// ParameterService manages per-database server parameters. Values are
+// written with ALTER SYSTEM, so they live in postgresql.auto.conf on the
+// volume and survive container recreation; the registry keeps a copy so they
+// can be reapplied to new clusters after upgrades and clones.
+type ParameterService struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+	Events       *events.Log
+}
+
+func (s *ParameterService) traced(ctx context.Context) *ParameterService {
+	t := *s
+	t.Docker = s.Docker.WithContext(ctx)
+	return &t
+}
+
+type setting struct {
+	Name    string `json:"name"`
+	Context string `json:"context"`
+}
+
+func (s *ParameterService) Get(ctx context.Context, name string) (model.ParametersResponse, error) {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return model.ParametersResponse{}, err
+	}
+
+	pending, err := pendingRestart(s.Docker, item)
+	if err != nil {
+		return model.ParametersResponse{}, err
+	}
+
+	return parametersResponse(item, pending, false), nil
+}
+
+func (s *ParameterService) Patch(ctx context.Context, name string, req model.PatchParametersRequest) (model.ParametersResponse, error) {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.ParametersResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.ParametersResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.ParametersResponse{}, databaseNotFound(name)
+	}
+
+	if err := applyParameters(s.Docker, item, req.Parameters); err != nil {
+		return model.ParametersResponse{}, err
+	}
+
+	params := make(map[string]string, len(item.Parameters)+len(req.Parameters))
+	for k, v := range item.Parameters {
+		params[k] = v
+	}
+	for k, v := range req.Parameters {
+		if v == nil {
+			delete(params, k)
+		} else {
+			params[k] = *v
+		}
+	}
+	item.Parameters = params
+	r.Items[idx] = item
+	if err := registry.Save(s.RegistryPath, r); err != nil {
+		return model.ParametersResponse{}, err
+	}
+
+	pending, err := pendingRestart(s.Docker, item)
+	if err != nil {
+		return model.ParametersResponse{}, err
+	}
+
+	restarted := false
+	if req.Restart && len(pending) > 0 {
+		if err := restartInstance(s.Docker, item); err != nil {
+			return model.ParametersResponse{}, err
+		}
+		restarted = true
+		s.Events.Publish(events.Restarted, name, map[string]any{"reason": "parameters", "parameters": pending})
+		if pending, err = pendingRestart(s.Docker, item); err != nil {
+			return model.ParametersResponse{}, err
+		}
+	}
+
+	return parametersResponse(item, pending, restarted), nil
+}
+
+func parametersResponse(item model.DBInstance, pending []string, restarted bool) model.ParametersResponse {
+	params := item.Parameters
+	if params == nil {
+		params = map[string]string{}
+	}
+	return model.ParametersResponse{Name: item.Name, Parameters: params, PendingRestart: pending, Restarted: restarted}
+}
+
+// applyParameters validates changes against pg_settings, writes them with
+// ALTER SYSTEM and reloads the configuration. A nil value resets the
+// parameter. If any statement fails, the ones already written are reverted
+// to their previous values from item.Parameters.
+func applyParameters(d *docker.Client, item model.DBInstance, changes map[string]*string) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		if !parameterNameRe.MatchString(name) {
+			return invalidParameter(name, "invalid parameter name '%s'", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, quoteLiteral(name))
+	}
+	var settings []setting
+	query := "SELECT name, context FROM pg_settings WHERE name IN (" + strings.Join(quoted, ", ") + ")"
+	if err := queryJSON(d, item, query, &settings); err != nil {
+		return fmt.Errorf("load server parameters: %w", err)
+	}
+	contexts := make(map[string]string, len(settings))
+	for _, st := range settings {
+		contexts[st.Name] = st.Context
+	}
+
+	for _, name := range names {
+		// Dotted names are extension placeholders, which only show up in
+		// pg_settings once the extension is loaded.
+		context, ok := contexts[name]
+		switch {
+		case !ok && !strings.Contains(name, "."):
+			return invalidParameter(name, "unknown parameter '%s'", name)
+		case context == "internal":
+			return invalidParameter(name, "parameter '%s' is read-only", name)
+		}
+	}
+
+	applied := []string{}
+	for _, name := range names {
+		if err := alterSystem(d, item, name, changes[name]); err != nil {
+			for i := len(applied) - 1; i >= 0; i-- {
+				var previous *string
+				if v, ok := item.Parameters[applied[i]]; ok {
+					previous = &v
+				}
+				_ = alterSystem(d, item, applied[i], previous)
+			}
+			return sqlInputError(fmt.Errorf("set parameter '%s': %w", name, err), map[string]any{"parameter": name})
+		}
+		applied = append(applied, name)
+	}
+
+	return reloadConf(d, item)
+}
+
+// reloadConf signals a configuration reload and waits until it has taken
+// effect. The postmaster rereads the files asynchronously; every psql call
+// runs in a new backend, which inherits the postmaster's load time.
+func reloadConf(d *docker.Client, item model.DBInstance) error {
+	before, err := execSQL(d, item, "SELECT pg_conf_load_time()")
+	if err != nil {
+		return fmt.Errorf("reload configuration: %w", err)
+	}
+	if _, err := execSQL(d, item, "SELECT pg_reload_conf()"); err != nil {
+		return fmt.Errorf("reload configuration: %w", err)
+	}
+
+	check := "SELECT pg_conf_load_time() > " + quoteLiteral(before) + "::timestamptz"
+	deadline := time.Now().Add(reloadTimeout)
+	for {
+		reloaded, err := execSQL(d, item, check)
+		if err != nil {
+			return fmt.Errorf("reload configuration: %w", err)
+		}
+		if reloaded == "t" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("reload configuration: not applied after %s", reloadTimeout)
+		}
+		time.Sleep(reloadPollInterval)
+	}
+}
+
+// alterSystem runs one statement per call because ALTER SYSTEM cannot run
+// inside the implicit transaction of a multi-statement psql -c.
+func alterSystem(d *docker.Client, item model.DBInstance, name string, value *string) error {
+	stmt := "ALTER SYSTEM RESET " + quoteIdent(name)
+	if value != nil {
+		stmt = "ALTER SYSTEM SET " + quoteIdent(name) + " = " + quoteLiteral(*value)
+	}
+	_, err := execSQL(d, item, stmt)
+	return err
+}
+
+// pendingRestart lists parameters whose new value only takes effect after a
+// restart. applyParameters waits for the reload, so it is current right
+// after a change.
+func pendingRestart(d *docker.Client, item model.DBInstance) ([]string, error) {
+	var rows []struct {
+		Name string `json:"name"`
+	}
+	if err := queryJSON(d, item, "SELECT name FROM pg_settings WHERE pending_restart ORDER BY name", &rows); err != nil {
+		return nil, fmt.Errorf("check pending restart: %w", err)
+	}
+
+	names := make([]string, 0, len(rows))
+	for _, row := range rows {
+		names = append(names, row.Name)
+	}
+	return names, nil
+}
+
+// configureParameters applies stored parameters to a freshly initialized
+// cluster and restarts it if any of them need a restart.
+func configureParameters(d *docker.Client, item model.DBInstance) error {
+	if len(item.Parameters) == 0 {
+		return nil
+	}
+	// Nothing was set on the new cluster yet, so a failed change should
+	// be reset rather than reverted to item's stored values.
+	fresh := item
+	fresh.Parameters = nil
+	if err := applyParameters(d, fresh, stringParams(item.Parameters)); err != nil {
+		return err
+	}
+
+	pending, err := pendingRestart(d, item)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	return restartInstance(d, item)
+}
+
+// configureDefaults gives a new cluster the parameters the daemon relies on,
+// pg_stat_statements for the queries endpoint and structured log files for
+// the logs endpoint, and installs pg_stat_statements. The parameters are
+// stored in entry.Parameters so clones and upgrades keep them.
+func configureDefaults(d *docker.Client, entry *model.DBInstance, version int) error {
+	preload, err := queryStatsPreload(d, *entry)
+	if err != nil {
+		return err
+	}
+	params := logParameters(version)
+	params["shared_preload_libraries"] = preload
+
+	entry.Parameters = params
+	if err := configureParameters(d, *entry); err != nil {
+		return fmt.Errorf("configure default parameters: %w", err)
+	}
+	if _, err := execSQL(d, *entry, "CREATE EXTENSION IF NOT EXISTS pg_stat_statements"); err != nil {
+		return fmt.Errorf("create extension pg_stat_statements: %w", err)
+	}
+	return nil
+}
+
+// stringParams converts stored parameters into a change set for
+// applyParameters.
+func stringParams(params map[string]string) map[string]*string {
+	out := make(map[string]*string, len(params))
+	for k, v := range params {
+		v := v
+		out[k] = &v
+	}
+	return out
+}
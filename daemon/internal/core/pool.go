@@ -0,0 +1,194 @@
+package core
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/tracing"
+	"pgdb/daemon/internal/util"
+)
+
+// poolPrefix names the containers and volumes of pooled instances. Deploy
+// names cannot contain underscores, so they never collide with a database.
+const poolPrefix = "pgdb-pool_"
+
+// claimPooled takes a ready instance of version out of r.Pool, renames its
+// container for name and gives the app role a fresh password. Only
+// deploys on the default image without initdb options can use the pool.
+// Pooled instances that fail to claim are removed and the next one is
+// tried; ok is false if none was claimed. Each instance taken out of the
+// pool is saved right away, so refills never count an instance that the
+// caller goes on to discard.
+func (d *Deployer) claimPooled(ctx context.Context, r *model.Registry, name string, version int, flavor string, initdb *model.InitdbOptions) (entry model.DBInstance, ok bool) {
+	if flavor != "" || initdb != nil {
+		return model.DBInstance{}, false
+	}
+
+	ctx, span := tracing.Start(ctx, "claim pooled", "postgres.version", version)
+	defer func() {
+		span.SetAttr("claimed", ok)
+		span.End(nil)
+	}()
+	d = d.traced(ctx)
+
+	key := strconv.Itoa(version)
+	for {
+		idx := -1
+		for i, it := range r.Pool {
+			if it.PostgresVersion == key {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return model.DBInstance{}, false
+		}
+
+		entry := r.Pool[idx]
+		rest := append(r.Pool[:idx:idx], r.Pool[idx+1:]...)
+		saved := *r
+		saved.Pool = rest
+		if err := registry.Save(d.RegistryPath, saved); err != nil {
+			return model.DBInstance{}, false
+		}
+		r.Pool = rest
+
+		password, err := util.RandomPassword(24)
+		if err != nil {
+			d.discard(entry)
+			continue
+		}
+		if err := d.Docker.RenameContainer(entry.ContainerID, "pgdb-"+name); err != nil {
+			d.discard(entry)
+			continue
+		}
+		if _, err := execSQL(d.Docker, entry, "ALTER ROLE "+quoteIdent(entry.User)+" PASSWORD "+quoteLiteral(password)); err != nil {
+			d.discard(entry)
+			continue
+		}
+		entry.Password = password
+		return entry, true
+	}
+}
+
+// Pool keeps the configured number of ready instances per version in the
+// registry's pool. Instances are started without the registry lock, which
+// is only taken to add them, so deploys are not blocked while it refills.
+type Pool struct {
+	RegistryPath string
+	LockPath     string
+	Deployer     *Deployer
+	Logger       *slog.Logger
+}
+
+func (p *Pool) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.refill(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) refill(ctx context.Context) {
+	counts, err := p.trim(ctx)
+	if err != nil {
+		p.Logger.Error("pool refill: trim failed", "error", err)
+		return
+	}
+
+	cfg := p.Deployer.Config
+	for _, major := range cfg.AllowedVersions() {
+		key := strconv.Itoa(major)
+		for n := counts[key]; n < cfg.Postgres.Versions[key].PoolSize && ctx.Err() == nil; n++ {
+			if err := p.add(ctx, major); err != nil {
+				p.Logger.Error("pool refill: start instance failed", "version", major, "error", err)
+				break
+			}
+		}
+	}
+}
+
+// trim removes pooled instances beyond the configured size of their
+// version and returns how many are left per version.
+func (p *Pool) trim(ctx context.Context) (map[string]int, error) {
+	unlock, err := registry.AcquireLock(ctx, p.LockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(p.RegistryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	var kept, surplus []model.DBInstance
+	for _, it := range r.Pool {
+		if counts[it.PostgresVersion] < p.Deployer.Config.Postgres.Versions[it.PostgresVersion].PoolSize {
+			counts[it.PostgresVersion]++
+			kept = append(kept, it)
+		} else {
+			surplus = append(surplus, it)
+		}
+	}
+	if len(surplus) == 0 {
+		return counts, nil
+	}
+
+	r.Pool = kept
+	if err := registry.Save(p.RegistryPath, r); err != nil {
+		return nil, err
+	}
+	for _, it := range surplus {
+		p.Deployer.discard(it)
+	}
+	return counts, nil
+}
+
+func (p *Pool) add(ctx context.Context, version int) error {
+	image, err := p.Deployer.Config.Image(strconv.Itoa(version), "")
+	if err != nil {
+		return err
+	}
+	suffix, err := util.RandomLowerAlphaNum(10)
+	if err != nil {
+		return err
+	}
+
+	entry, err := p.Deployer.startCluster(ctx, poolPrefix+suffix, version, image, nil)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := registry.AcquireLock(ctx, p.LockPath)
+	if err != nil {
+		p.Deployer.discard(entry)
+		return err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(p.RegistryPath)
+	if err != nil {
+		p.Deployer.discard(entry)
+		return err
+	}
+	r.Pool = append(r.Pool, entry)
+	if err := registry.Save(p.RegistryPath, r); err != nil {
+		p.Deployer.discard(entry)
+		return err
+	}
+
+	p.Logger.Info("pool instance ready", "version", version, "container", poolPrefix+suffix)
+	return nil
+}
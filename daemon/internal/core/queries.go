@@ -0,0 +1,181 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+)
+
+const (
+	defaultQueryLimit = 20
+	maxQueryLimit     = 500
+)
+
+// QueryStatsService reports the statements an instance spends its time on,
+// from pg_stat_statements. Deploys preload the module and create the
+// extension; older databases need both done through the parameters and
+// extensions endpoints first.
+type QueryStatsService struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+}
+
+func (s *QueryStatsService) traced(ctx context.Context) *QueryStatsService {
+	t := *s
+	t.Docker = s.Docker.WithContext(ctx)
+	return &t
+}
+
+// Top returns up to limit statements ordered by sort: "total_time"
+// (default), "calls" or "mean_time". Statements run by the daemon's admin
+// role are left out.
+func (s *QueryStatsService) Top(ctx context.Context, name, sort string, limit int) (model.QueriesResponse, error) {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return model.QueriesResponse{}, err
+	}
+	if err := checkQueryStats(s.Docker, item); err != nil {
+		return model.QueriesResponse{}, err
+	}
+
+	if sort == "" {
+		sort = "total_time"
+	}
+	if limit == 0 {
+		limit = defaultQueryLimit
+	}
+	if limit < 1 || limit > maxQueryLimit {
+		return model.QueriesResponse{}, invalidField("limit", "limit must be between 1 and %d", maxQueryLimit)
+	}
+
+	// pg_stat_statements 1.8 (Postgres 13) split planning from execution
+	// time and renamed the columns.
+	totalCol, meanCol := "s.total_exec_time", "s.mean_exec_time"
+	if version, _ := strconv.Atoi(item.PostgresVersion); version > 0 && version < 13 {
+		totalCol, meanCol = "s.total_time", "s.mean_time"
+	}
+	orderBy := map[string]string{"total_time": totalCol, "calls": "s.calls", "mean_time": meanCol}[sort]
+	if orderBy == "" {
+		return model.QueriesResponse{}, invalidField("sort", "invalid sort '%s' (must be total_time, calls or mean_time)", sort)
+	}
+
+	query := fmt.Sprintf(`SELECT s.queryid::text AS query_id, d.datname AS database, r.rolname AS "user", s.query,
+		s.calls, %s AS total_time_ms, %s AS mean_time_ms, s.rows
+		FROM pg_stat_statements s
+		LEFT JOIN pg_database d ON d.oid = s.dbid
+		LEFT JOIN pg_roles r ON r.oid = s.userid
+		WHERE r.rolname IS DISTINCT FROM %s
+		ORDER BY %s DESC LIMIT %d`, totalCol, meanCol, quoteLiteral(item.AdminUser), orderBy, limit)
+
+	items := []model.QueryStat{}
+	if err := queryJSON(s.Docker, item, query, &items); err != nil {
+		return model.QueriesResponse{}, fmt.Errorf("load query statistics: %w", err)
+	}
+	return model.QueriesResponse{Name: name, Sort: sort, Items: items}, nil
+}
+
+// Reset discards the statistics gathered so far for the whole instance.
+func (s *QueryStatsService) Reset(ctx context.Context, name string) error {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return err
+	}
+	if err := checkQueryStats(s.Docker, item); err != nil {
+		return err
+	}
+	if _, err := execSQL(s.Docker, item, "SELECT pg_stat_statements_reset()"); err != nil {
+		return fmt.Errorf("reset query statistics: %w", err)
+	}
+	return nil
+}
+
+func checkQueryStats(d *docker.Client, item model.DBInstance) error {
+	var rows []struct {
+		Installed bool   `json:"installed"`
+		Preload   string `json:"preload"`
+	}
+	query := `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_stat_statements') AS installed,
+		current_setting('shared_preload_libraries') AS preload`
+	if err := queryJSON(d, item, query, &rows); err != nil {
+		return err
+	}
+	if len(rows) == 0 || !rows[0].Installed || !settingListHas(rows[0].Preload, "pg_stat_statements") {
+		return conflict("pg_stat_statements is not enabled on '%s': add it to shared_preload_libraries with a restart, then create the extension", item.Name)
+	}
+	return nil
+}
+
+// queryStatsPreload returns shared_preload_libraries with
+// pg_stat_statements added to what the image already preloads.
+func queryStatsPreload(d *docker.Client, item model.DBInstance) (string, error) {
+	preload, err := execSQL(d, item, "SHOW shared_preload_libraries")
+	if err != nil {
+		return "", err
+	}
+	if settingListHas(preload, "pg_stat_statements") {
+		return preload, nil
+	}
+	if preload = strings.TrimSpace(preload); preload != "" {
+		preload += ","
+	}
+	return preload + "pg_stat_statements", nil
+}
+
+// settingListHas reports whether a comma-separated setting such as
+// shared_preload_libraries contains value.
+func settingListHas(list, value string) bool {
+	for _, name := range strings.Split(list, ",") {
+		if strings.Trim(strings.TrimSpace(name), `"`) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// listParameters are comma-separated settings whose defaults are kept
+// when a deploy sets its own value, so for example preloading timescaledb
+// does not unload pg_stat_statements.
+var listParameters = map[string]bool{"shared_preload_libraries": true}
+
+// mergeParameters returns defaults overlaid with params.
+func mergeParameters(defaults, params map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return params
+	}
+	out := make(map[string]string, len(defaults)+len(params))
+	for k, v := range defaults {
+		out[k] = v
+	}
+	for k, v := range params {
+		if listParameters[k] {
+			v = mergeSettingList(v, defaults[k])
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// mergeSettingList appends the entries of extra that list lacks.
+func mergeSettingList(list, extra string) string {
+	list = strings.TrimSpace(list)
+	for _, name := range strings.Split(extra, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || settingListHas(list, strings.Trim(name, `"`)) {
+			continue
+		}
+		if list != "" {
+			list += ","
+		}
+		list += name
+	}
+	return list
+}
@@ -0,0 +1,289 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/util"
+)
+
+const (
+	RoleReadOnly  = "readonly"
+	RoleReadWrite = "readwrite"
+	RoleOwner     = "owner"
+)
+
+var roleNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{2,62}$`)
+
+// RoleService manages extra login roles of a database. Their passwords are
+// kept in the registry next to the primary credential.
+type RoleService struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+}
+
+func (s *RoleService) traced(ctx context.Context) *RoleService {
+	t := *s
+	t.Docker = s.Docker.WithContext(ctx)
+	return &t
+}
+
+func (s *RoleService) List(ctx context.Context, name string) (model.RolesResponse, error) {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return model.RolesResponse{}, err
+	}
+
+	items := make([]model.RoleCredentials, 0, len(item.Roles))
+	for _, role := range item.Roles {
+		items = append(items, roleCredentials(item, role))
+	}
+	return model.RolesResponse{Name: name, Items: items}, nil
+}
+
+func (s *RoleService) Create(ctx context.Context, name string, req model.CreateRoleRequest) (model.RoleCredentials, error) {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.RoleCredentials{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.RoleCredentials{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.RoleCredentials{}, databaseNotFound(name)
+	}
+	if err := checkRoleSupport(item); err != nil {
+		return model.RoleCredentials{}, err
+	}
+
+	roleName := strings.ToLower(strings.TrimSpace(req.Name))
+	if err := checkRoleName(item, roleName); err != nil {
+		return model.RoleCredentials{}, err
+	}
+	template := strings.ToLower(strings.TrimSpace(req.Template))
+	grants, err := grantTemplateSQL(item, template, roleName)
+	if err != nil {
+		return model.RoleCredentials{}, err
+	}
+
+	password, err := util.RandomPassword(24)
+	if err != nil {
+		return model.RoleCredentials{}, err
+	}
+
+	sql := fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD %s NOSUPERUSER NOCREATEDB NOCREATEROLE NOREPLICATION NOBYPASSRLS; %s",
+		quoteIdent(roleName), quoteLiteral(password), grants)
+	if _, err := execSQL(s.Docker, item, sql); err != nil {
+		return model.RoleCredentials{}, sqlInputError(fmt.Errorf("create role '%s': %w", roleName, err), map[string]any{"field": "name"})
+	}
+
+	role := model.Role{Name: roleName, Template: template, Password: password, CreatedAt: util.NowRFC3339()}
+	item.Roles = append(item.Roles, role)
+	r.Items[idx] = item
+	if err := registry.Save(s.RegistryPath, r); err != nil {
+		_, _ = execSQL(s.Docker, item, dropRoleSQL(item, roleName))
+		return model.RoleCredentials{}, err
+	}
+
+	return roleCredentials(item, role), nil
+}
+
+// Rotate sets a new password for a role. Sessions opened with the old
+// password stay connected.
+func (s *RoleService) Rotate(ctx context.Context, name, roleName string) (model.RoleCredentials, error) {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.RoleCredentials{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.RoleCredentials{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.RoleCredentials{}, databaseNotFound(name)
+	}
+	ri := findRole(item, roleName)
+	if ri < 0 {
+		return model.RoleCredentials{}, notFound("role '%s' not found in database '%s'", roleName, name)
+	}
+
+	password, err := util.RandomPassword(24)
+	if err != nil {
+		return model.RoleCredentials{}, err
+	}
+	sql := fmt.Sprintf("ALTER ROLE %s PASSWORD %s", quoteIdent(roleName), quoteLiteral(password))
+	if _, err := execSQL(s.Docker, item, sql); err != nil {
+		return model.RoleCredentials{}, fmt.Errorf("rotate role '%s': %w", roleName, err)
+	}
+
+	item.Roles[ri].Password = password
+	item.Roles[ri].RotatedAt = util.NowRFC3339()
+	r.Items[idx] = item
+	if err := registry.Save(s.RegistryPath, r); err != nil {
+		return model.RoleCredentials{}, err
+	}
+
+	return roleCredentials(item, item.Roles[ri]), nil
+}
+
+// Drop terminates the role's sessions, hands anything it created to the app
+// role and removes it.
+func (s *RoleService) Drop(ctx context.Context, name, roleName string) error {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return databaseNotFound(name)
+	}
+	ri := findRole(item, roleName)
+	if ri < 0 {
+		return notFound("role '%s' not found in database '%s'", roleName, name)
+	}
+
+	if _, err := execSQL(s.Docker, item, dropRoleSQL(item, roleName)); err != nil {
+		return fmt.Errorf("drop role '%s': %w", roleName, err)
+	}
+
+	item.Roles = append(item.Roles[:ri], item.Roles[ri+1:]...)
+	r.Items[idx] = item
+	return registry.Save(s.RegistryPath, r)
+}
+
+func roleCredentials(item model.DBInstance, role model.Role) model.RoleCredentials {
+	login := item
+	login.User = role.Name
+	login.Password = role.Password
+	return model.RoleCredentials{
+		Name:        role.Name,
+		Template:    role.Template,
+		Password:    role.Password,
+		DatabaseURL: makeDatabaseURL(login),
+		CreatedAt:   role.CreatedAt,
+		RotatedAt:   role.RotatedAt,
+	}
+}
+
+func findRole(item model.DBInstance, roleName string) int {
+	for i, role := range item.Roles {
+		if role.Name == roleName {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkRoleSupport rejects databases whose app user is still a superuser:
+// membership in it would hand out superuser rights through SET ROLE.
+func checkRoleSupport(item model.DBInstance) error {
+	if item.AdminUser == "" {
+		return conflict("database '%s' still uses a superuser app role; call migrate-roles first", item.Name)
+	}
+	return nil
+}
+
+func checkRoleName(item model.DBInstance, roleName string) error {
+	if !roleNameRe.MatchString(roleName) {
+		return invalidField("name", "invalid role name '%s' (must match %s)", roleName, roleNameRe.String())
+	}
+	if strings.HasPrefix(roleName, "pg_") || strings.HasPrefix(roleName, "pgdb_") || strings.HasPrefix(roleName, "tmp_") {
+		return invalidField("name", "role name '%s' uses a reserved prefix", roleName)
+	}
+	taken := roleName == item.User || roleName == ownerRole(item) || findRole(item, roleName) >= 0
+	for _, cred := range item.RetiredCredentials {
+		taken = taken || roleName == cred.User
+	}
+	for _, db := range item.Databases {
+		taken = taken || roleName == db.User
+	}
+	if taken {
+		return conflict("role '%s' already exists in database '%s'", roleName, item.Name)
+	}
+	return nil
+}
+
+// grantTemplateSQL returns the grants for a privilege template. Read-only and
+// read-write roles get access to existing objects in every user schema plus
+// default privileges for objects the app role creates later. Owner roles
+// become members of the app role and switch to it on login, so objects
+// they create (for example in migrations) are owned by the app role.
+func grantTemplateSQL(item model.DBInstance, template, roleName string) (string, error) {
+	role := quoteIdent(roleName)
+	owner := quoteIdent(ownerRole(item))
+	connect := fmt.Sprintf("GRANT CONNECT ON DATABASE %s TO %s;", quoteIdent(item.DB), role)
+
+	var tables, sequences string
+	switch template {
+	case RoleReadOnly:
+		tables, sequences = "SELECT", "SELECT"
+	case RoleReadWrite:
+		tables, sequences = "SELECT, INSERT, UPDATE, DELETE", "USAGE, SELECT, UPDATE"
+	case RoleOwner:
+		return connect + fmt.Sprintf(" GRANT %s TO %s; ALTER ROLE %s SET role = %s;", owner, role, role, quoteLiteral(ownerRole(item))), nil
+	default:
+		return "", invalidField("template", "unknown template '%s' (must be one of readonly, readwrite, owner)", template)
+	}
+
+	// Before PostgreSQL 15 every role may create objects in public.
+	return connect + `
+DO $pgdb$
+DECLARE
+	s text;
+	grantee text := ` + quoteLiteral(roleName) + `;
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_namespace WHERE nspname = 'public') THEN
+		REVOKE CREATE ON SCHEMA public FROM PUBLIC;
+	END IF;
+	FOR s IN SELECT nspname FROM pg_namespace
+		WHERE nspname NOT LIKE 'pg\_%' AND nspname <> 'information_schema'
+	LOOP
+		EXECUTE format('GRANT USAGE ON SCHEMA %I TO %I', s, grantee);
+		EXECUTE format('GRANT ` + tables + ` ON ALL TABLES IN SCHEMA %I TO %I', s, grantee);
+		EXECUTE format('GRANT ` + sequences + ` ON ALL SEQUENCES IN SCHEMA %I TO %I', s, grantee);
+	END LOOP;
+END
+$pgdb$;` + fmt.Sprintf(`
+ALTER DEFAULT PRIVILEGES FOR ROLE %[1]s GRANT USAGE ON SCHEMAS TO %[2]s;
+ALTER DEFAULT PRIVILEGES FOR ROLE %[1]s GRANT %[3]s ON TABLES TO %[2]s;
+ALTER DEFAULT PRIVILEGES FOR ROLE %[1]s GRANT %[4]s ON SEQUENCES TO %[2]s;`, owner, role, tables, sequences), nil
+}
+
+// dropRoleSQL ends the role's sessions and removes it together with its
+// grants and default privileges.
+func dropRoleSQL(item model.DBInstance, roleName string) string {
+	role := quoteIdent(roleName)
+	return fmt.Sprintf("SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE usename = %s; "+
+		"REASSIGN OWNED BY %s TO %s; DROP OWNED BY %s; DROP ROLE %s;",
+		quoteLiteral(roleName), role, quoteIdent(ownerRole(item)), role, role)
+}
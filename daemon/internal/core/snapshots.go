@@ -0,0 +1,232 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/util"
+)
+
+var snapshotNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// SnapshotService keeps fixture states of a database as template databases
+// inside the same instance. Taking a snapshot or resetting to one copies
+// files inside the cluster, so it takes milliseconds for small fixtures.
+// Both briefly block connections to the database and terminate its
+// sessions, because Postgres cannot copy a database that is in use.
+type SnapshotService struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+}
+
+func (s *SnapshotService) traced(ctx context.Context) *SnapshotService {
+	t := *s
+	t.Docker = s.Docker.WithContext(ctx)
+	return &t
+}
+
+func (s *SnapshotService) List(ctx context.Context, name string) (model.SnapshotsResponse, error) {
+	s = s.traced(ctx)
+
+	item, err := lookupInstance(ctx, s.RegistryPath, s.LockPath, name)
+	if err != nil {
+		return model.SnapshotsResponse{}, err
+	}
+
+	items := item.Snapshots
+	if items == nil {
+		items = []model.Snapshot{}
+	}
+	return model.SnapshotsResponse{Name: name, Items: items}, nil
+}
+
+func (s *SnapshotService) Create(ctx context.Context, name string, req model.CreateSnapshotRequest) (model.Snapshot, error) {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.Snapshot{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.Snapshot{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.Snapshot{}, databaseNotFound(name)
+	}
+
+	snapName := strings.ToLower(strings.TrimSpace(req.Name))
+	if !snapshotNameRe.MatchString(snapName) {
+		return model.Snapshot{}, invalidField("name", "invalid snapshot name '%s' (must match %s)", req.Name, snapshotNameRe.String())
+	}
+	if findSnapshot(item, snapName) >= 0 {
+		return model.Snapshot{}, conflict("snapshot '%s' already exists in '%s'", snapName, name)
+	}
+	snap := model.Snapshot{Name: snapName, Database: item.DB + "_snap_" + snapName, CreatedAt: util.NowRFC3339()}
+	if findDatabase(item, snap.Database) >= 0 {
+		return model.Snapshot{}, conflict("database '%s' already exists in '%s'", snap.Database, name)
+	}
+
+	err = s.withoutConnections(item, func() error {
+		_, err := execSQLOn(s.Docker, item, "postgres", fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s OWNER %s",
+			quoteIdent(snap.Database), quoteIdent(item.DB), quoteIdent(ownerRole(item))))
+		return err
+	})
+	if err != nil {
+		return model.Snapshot{}, fmt.Errorf("create snapshot '%s': %w", snapName, err)
+	}
+	// Apps must not connect to the snapshot and change the fixture.
+	lock := fmt.Sprintf("ALTER DATABASE %s IS_TEMPLATE true ALLOW_CONNECTIONS false", quoteIdent(snap.Database))
+	if _, err := execSQLOn(s.Docker, item, "postgres", lock); err != nil {
+		_ = dropSnapshot(s.Docker, item, snap)
+		return model.Snapshot{}, fmt.Errorf("create snapshot '%s': %w", snapName, err)
+	}
+
+	item.Snapshots = append(item.Snapshots, snap)
+	r.Items[idx] = item
+	if err := registry.Save(s.RegistryPath, r); err != nil {
+		_ = dropSnapshot(s.Docker, item, snap)
+		return model.Snapshot{}, err
+	}
+
+	return snap, nil
+}
+
+// Reset replaces the database with a copy of a snapshot, or of the most
+// recent one if snapName is empty. The copy is made under a temporary name
+// first, so a failed reset leaves the database untouched.
+func (s *SnapshotService) Reset(ctx context.Context, name, snapName string) (model.ResetResponse, error) {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return model.ResetResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return model.ResetResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.ResetResponse{}, databaseNotFound(name)
+	}
+
+	if len(item.Snapshots) == 0 {
+		return model.ResetResponse{}, conflict("database '%s' has no snapshots", name)
+	}
+	snap := item.Snapshots[len(item.Snapshots)-1]
+	if snapName != "" {
+		si := findSnapshot(item, snapName)
+		if si < 0 {
+			return model.ResetResponse{}, notFound("snapshot '%s' not found in '%s'", snapName, name)
+		}
+		snap = item.Snapshots[si]
+	}
+
+	started := time.Now()
+	staging := item.DB + "_reset"
+	_, err = execSQLOn(s.Docker, item, "postgres", fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s OWNER %s",
+		quoteIdent(staging), quoteIdent(snap.Database), quoteIdent(ownerRole(item))))
+	if err != nil {
+		return model.ResetResponse{}, fmt.Errorf("copy snapshot '%s': %w", snap.Name, err)
+	}
+
+	err = s.withoutConnections(item, func() error {
+		if _, err := execSQLOn(s.Docker, item, "postgres", "DROP DATABASE "+quoteIdent(item.DB)); err != nil {
+			return err
+		}
+		_, err := execSQLOn(s.Docker, item, "postgres", fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", quoteIdent(staging), quoteIdent(item.DB)))
+		return err
+	})
+	if err != nil {
+		_, _ = execSQLOn(s.Docker, item, "postgres", "DROP DATABASE IF EXISTS "+quoteIdent(staging))
+		return model.ResetResponse{}, fmt.Errorf("reset to snapshot '%s': %w", snap.Name, err)
+	}
+
+	return model.ResetResponse{Name: name, Snapshot: snap.Name, DurationMS: time.Since(started).Milliseconds()}, nil
+}
+
+func (s *SnapshotService) Delete(ctx context.Context, name, snapName string) error {
+	s = s.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(s.RegistryPath)
+	if err != nil {
+		return err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return databaseNotFound(name)
+	}
+	si := findSnapshot(item, snapName)
+	if si < 0 {
+		return notFound("snapshot '%s' not found in '%s'", snapName, name)
+	}
+
+	if err := dropSnapshot(s.Docker, item, item.Snapshots[si]); err != nil {
+		return fmt.Errorf("delete snapshot '%s': %w", snapName, err)
+	}
+
+	item.Snapshots = append(item.Snapshots[:si], item.Snapshots[si+1:]...)
+	r.Items[idx] = item
+	return registry.Save(s.RegistryPath, r)
+}
+
+// withoutConnections runs fn while the database refuses new connections
+// and has no sessions. Connections are allowed again afterwards, whether
+// fn succeeded or not; if fn replaced the database, the new one allows
+// connections already.
+func (s *SnapshotService) withoutConnections(item model.DBInstance, fn func() error) error {
+	db := quoteIdent(item.DB)
+	if _, err := execSQLOn(s.Docker, item, "postgres", "ALTER DATABASE "+db+" ALLOW_CONNECTIONS false"); err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = execSQLOn(s.Docker, item, "postgres", "ALTER DATABASE "+db+" ALLOW_CONNECTIONS true")
+	}()
+
+	terminate := fmt.Sprintf("SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE datname = %s AND pid <> pg_backend_pid()",
+		quoteLiteral(item.DB))
+	if _, err := execSQLOn(s.Docker, item, "postgres", terminate); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func dropSnapshot(d *docker.Client, item model.DBInstance, snap model.Snapshot) error {
+	db := quoteIdent(snap.Database)
+	if _, err := execSQLOn(d, item, "postgres", "ALTER DATABASE "+db+" IS_TEMPLATE false"); err != nil {
+		return err
+	}
+	_, err := execSQLOn(d, item, "postgres", "DROP DATABASE IF EXISTS "+db)
+	return err
+}
+
+func findSnapshot(item model.DBInstance, snapName string) int {
+	for i, snap := range item.Snapshots {
+		if snap.Name == snapName {
+			return i
+		}
+	}
+	return -1
+}
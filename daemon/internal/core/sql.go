@@ -0,0 +1,32 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+)
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return `'` + strings.ReplaceAll(value, `'`, `''`) + `'`
+}
+
+// queryJSON runs a row-returning query inside the instance container and
+// decodes the rows into out, which must be a pointer to a slice.
+func queryJSON(d *docker.Client, item model.DBInstance, query string, out any) error {
+	wrapped := "SELECT coalesce(json_agg(t), '[]'::json) FROM (" + query + ") t"
+	text, err := execSQL(d, item, wrapped)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(text), out); err != nil {
+		return fmt.Errorf("parse query result: %w", err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 
@@ -13,8 +14,8 @@ type StatusService struct {
 	LockPath     string
 }
 
-func (s *StatusService) Status() (model.StatusResponse, error) {
-	unlock, err := registry.AcquireLock(s.LockPath)
+func (s *StatusService) Status(ctx context.Context) (model.StatusResponse, error) {
+	unlock, err := registry.AcquireLock(ctx, s.LockPath)
 	if err != nil {
 		return model.StatusResponse{}, err
 	}
@@ -28,17 +29,26 @@ func (s *StatusService) Status() (model.StatusResponse, error) {
 	items := make([]model.StatusItem, 0, len(r.Items))
 	for _, it := range r.Items {
 		items = append(items, model.StatusItem{
-			Name:            it.Name,
-			ContainerID:     it.ContainerID,
-			VolumeName:      it.VolumeName,
-			Host:            it.Host,
-			HostPort:        it.HostPort,
-			DB:              it.DB,
-			User:            it.User,
-			Password:        it.Password,
-			CreatedAt:       it.CreatedAt,
-			PostgresVersion: it.PostgresVersion,
-			DatabaseURL:     makeDatabaseURLForStatus(it),
+			Name:               it.Name,
+			ContainerID:        it.ContainerID,
+			VolumeName:         it.VolumeName,
+			Host:               it.Host,
+			HostPort:           it.HostPort,
+			DB:                 it.DB,
+			User:               it.User,
+			Password:           it.Password,
+			CreatedAt:          it.CreatedAt,
+			PostgresVersion:    it.PostgresVersion,
+			DatabaseURL:        makeDatabaseURLForStatus(it),
+			PendingUpgrade:     it.PendingUpgrade,
+			ImageDigest:        it.ImageDigest,
+			MaintenanceWindow:  it.MaintenanceWindow,
+			Flavor:             it.Flavor,
+			Parameters:         it.Parameters,
+			Initdb:             it.Initdb,
+			RetiredCredentials: it.RetiredCredentials,
+			Databases:          databaseInfos(it),
+			ExpiresAt:          it.ExpiresAt,
 		})
 	}
 
@@ -0,0 +1,330 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"pgdb/daemon/internal/config"
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/events"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/util"
+)
+
+const (
+	ImageUpdated = "updated"
+	ImageCurrent = "current"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Updater refreshes containers to the latest patch release of their major
+// version by pulling the image and recreating the container on the same
+// volume and port.
+type Updater struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+	Config       *config.Config
+	Logger       *slog.Logger
+	Events       *events.Log
+	// DefaultWindow applies to databases without a maintenance window of
+	// their own. When it is empty, Run leaves those databases alone.
+	DefaultWindow string
+}
+
+func (u *Updater) traced(ctx context.Context) *Updater {
+	t := *u
+	t.Docker = u.Docker.WithContext(ctx)
+	return &t
+}
+
+func (u *Updater) Update(ctx context.Context, name string) (model.ImageUpdateResponse, error) {
+	u = u.traced(ctx)
+
+	r, err := registry.Load(u.RegistryPath)
+	if err != nil {
+		return model.ImageUpdateResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.ImageUpdateResponse{}, databaseNotFound(name)
+	}
+
+	// Pull outside the registry lock; it can take a while.
+	image, err := u.Config.Image(item.PostgresVersion, item.Flavor)
+	if err != nil {
+		return model.ImageUpdateResponse{}, err
+	}
+	if err := u.Docker.PullImage(image); err != nil {
+		return model.ImageUpdateResponse{}, err
+	}
+
+	return u.recreate(ctx, name, image)
+}
+
+func (u *Updater) recreate(ctx context.Context, name, image string) (model.ImageUpdateResponse, error) {
+	unlock, err := registry.AcquireLock(ctx, u.LockPath)
+	if err != nil {
+		return model.ImageUpdateResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(u.RegistryPath)
+	if err != nil {
+		return model.ImageUpdateResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.ImageUpdateResponse{}, databaseNotFound(name)
+	}
+
+	digest, err := u.Docker.ImageDigest(image)
+	if err != nil {
+		return model.ImageUpdateResponse{}, err
+	}
+
+	resp := model.ImageUpdateResponse{
+		Name:           name,
+		State:          ImageCurrent,
+		Image:          image,
+		PreviousDigest: item.ImageDigest,
+		Digest:         digest,
+	}
+	if digest == item.ImageDigest {
+		return resp, nil
+	}
+
+	// Stop first so Postgres shuts down cleanly with a checkpoint instead of
+	// being killed and running crash recovery on the new image.
+	if err := u.Docker.StopContainer(item.ContainerID); err != nil {
+		return model.ImageUpdateResponse{}, err
+	}
+	if err := u.Docker.RemoveContainerForce(item.ContainerID); err != nil {
+		return model.ImageUpdateResponse{}, err
+	}
+
+	containerID, err := startInstance(u.Docker, item, image)
+	if err != nil {
+		if item.ImageDigest == "" {
+			return model.ImageUpdateResponse{}, fmt.Errorf("start updated container (no previous digest to roll back to): %w", err)
+		}
+		restoredID, restartErr := startInstance(u.Docker, item, item.ImageDigest)
+		if restartErr != nil {
+			return model.ImageUpdateResponse{}, fmt.Errorf("start updated container: %w; roll back to %s: %v", err, item.ImageDigest, restartErr)
+		}
+		item.ContainerID = restoredID
+		r.Items[idx] = item
+		_ = registry.Save(u.RegistryPath, r)
+		return model.ImageUpdateResponse{}, fmt.Errorf("start updated container (rolled back to %s): %w", item.ImageDigest, err)
+	}
+
+	item.ContainerID = containerID
+	item.ImageDigest = digest
+	item.ImageUpdatedAt = util.NowRFC3339()
+	r.Items[idx] = item
+	if err := registry.Save(u.RegistryPath, r); err != nil {
+		return model.ImageUpdateResponse{}, err
+	}
+
+	resp.State = ImageUpdated
+	u.Events.Publish(events.Restarted, name, map[string]any{"reason": "image_update", "image": image, "digest": digest})
+	return resp, nil
+}
+
+// Run updates every database whose maintenance window is open at each tick.
+// Databases without a window use DefaultWindow; with neither, they are only
+// updated through Update.
+func (u *Updater) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.updateDue(ctx, time.Now().UTC())
+		}
+	}
+}
+
+func (u *Updater) updateDue(ctx context.Context, now time.Time) {
+	r, err := registry.Load(u.RegistryPath)
+	if err != nil {
+		u.Logger.Error("image update: load registry failed", "error", err)
+		return
+	}
+
+	pulled := map[string]error{}
+	for _, item := range r.Items {
+		raw := item.MaintenanceWindow
+		if raw == "" {
+			raw = u.DefaultWindow
+		}
+		if raw == "" {
+			continue
+		}
+		window, err := parseMaintenanceWindow(raw)
+		if err != nil {
+			u.Logger.Error("image update: invalid maintenance window", "name", item.Name, "error", err)
+			continue
+		}
+		if !window.contains(now) {
+			continue
+		}
+
+		image, err := u.Config.Image(item.PostgresVersion, item.Flavor)
+		if err != nil {
+			u.Logger.Error("image update: no configured image", "name", item.Name, "error", err)
+			continue
+		}
+		if _, ok := pulled[image]; !ok {
+			pulled[image] = u.Docker.PullImage(image)
+		}
+		if pulled[image] != nil {
+			u.Logger.Error("image update: pull failed", "name", item.Name, "image", image, "error", pulled[image])
+			continue
+		}
+
+		resp, err := u.recreate(ctx, item.Name, image)
+		if err != nil {
+			u.Logger.Error("image update failed", "name", item.Name, "image", image, "error", err)
+			continue
+		}
+		if resp.State == ImageUpdated {
+			u.Logger.Info("image updated", "name", item.Name, "image", image, "digest", resp.Digest, "previous_digest", resp.PreviousDigest)
+		}
+	}
+}
+
+func (u *Updater) SetMaintenanceWindow(ctx context.Context, name, window string) error {
+	window = strings.ToLower(strings.TrimSpace(window))
+	if _, err := parseMaintenanceWindow(window); err != nil {
+		return err
+	}
+
+	unlock, err := registry.AcquireLock(ctx, u.LockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(u.RegistryPath)
+	if err != nil {
+		return err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return databaseNotFound(name)
+	}
+
+	item.MaintenanceWindow = window
+	r.Items[idx] = item
+	return registry.Save(u.RegistryPath, r)
+}
+
+// maintenanceWindow is a daily or weekly UTC time range in minutes since
+// midnight. A range whose end is before its start wraps past midnight, and
+// the weekday applies to the day the window opens.
+type maintenanceWindow struct {
+	weekly bool
+	day    time.Weekday
+	start  int
+	end    int
+}
+
+// CheckMaintenanceWindow reports whether raw is a valid maintenance
+// window, for settings read outside the API.
+func CheckMaintenanceWindow(raw string) error {
+	_, err := parseMaintenanceWindow(raw)
+	return err
+}
+
+// parseMaintenanceWindow accepts "" (no window), "HH:MM-HH:MM" or
+// "ddd HH:MM-HH:MM", e.g. "sun 02:00-04:00", all in UTC.
+func parseMaintenanceWindow(raw string) (maintenanceWindow, error) {
+	if raw == "" {
+		return maintenanceWindow{}, nil
+	}
+
+	errWindow := invalidField("window", "invalid maintenance window '%s' (expected \"[ddd ]HH:MM-HH:MM\" in UTC)", raw)
+
+	var w maintenanceWindow
+	fields := strings.Fields(raw)
+	switch len(fields) {
+	case 1:
+	case 2:
+		day, ok := weekdays[fields[0]]
+		if !ok {
+			return maintenanceWindow{}, errWindow
+		}
+		w.weekly = true
+		w.day = day
+		fields = fields[1:]
+	default:
+		return maintenanceWindow{}, errWindow
+	}
+
+	startRaw, endRaw, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return maintenanceWindow{}, errWindow
+	}
+	var err error
+	if w.start, err = parseClock(startRaw); err != nil {
+		return maintenanceWindow{}, errWindow
+	}
+	if w.end, err = parseClock(endRaw); err != nil {
+		return maintenanceWindow{}, errWindow
+	}
+	if w.start == w.end {
+		return maintenanceWindow{}, errWindow
+	}
+
+	return w, nil
+}
+
+func parseClock(raw string) (int, error) {
+	hh, mm, ok := strings.Cut(raw, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid clock")
+	}
+	h, err := strconv.Atoi(hh)
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("invalid hour")
+	}
+	m, err := strconv.Atoi(mm)
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid minute")
+	}
+	return h*60 + m, nil
+}
+
+func (w maintenanceWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	openedOn := t.Weekday()
+	switch {
+	case w.start < w.end:
+		if minute < w.start || minute >= w.end {
+			return false
+		}
+	case minute >= w.start:
+	case minute < w.end:
+		openedOn = t.Add(-24 * time.Hour).Weekday()
+	default:
+		return false
+	}
+
+	return !w.weekly || openedOn == w.day
+}
@@ -0,0 +1,456 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"pgdb/daemon/internal/config"
+	"pgdb/daemon/internal/docker"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/registry"
+	"pgdb/daemon/internal/util"
+)
+
+const (
+	UpgradePendingConfirmation = "pending_confirmation"
+	UpgradeConfirmed           = "confirmed"
+	UpgradeRolledBack          = "rolled_back"
+)
+
+type Upgrader struct {
+	RegistryPath string
+	LockPath     string
+	Docker       *docker.Client
+	Config       *config.Config
+}
+
+func (u *Upgrader) traced(ctx context.Context) *Upgrader {
+	t := *u
+	t.Docker = u.Docker.WithContext(ctx)
+	return &t
+}
+
+// Upgrade moves a database to a newer major version by restoring a
+// pg_dumpall of the current container into a staging container on a new
+// volume. Logins other than the admin role are blocked from the dump until
+// the swap, so no write is lost in between. The old volume is kept until
+// Confirm or Rollback is called.
+func (u *Upgrader) Upgrade(ctx context.Context, name string, req model.UpgradeRequest) (model.UpgradeResponse, error) {
+	u = u.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, u.LockPath)
+	if err != nil {
+		return model.UpgradeResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(u.RegistryPath)
+	if err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.UpgradeResponse{}, databaseNotFound(name)
+	}
+	// The app role of legacy databases is the role running the dump, so its
+	// logins cannot be blocked.
+	if err := checkRoleSupport(item); err != nil {
+		return model.UpgradeResponse{}, err
+	}
+	if item.PendingUpgrade != nil {
+		return model.UpgradeResponse{}, conflict("upgrade of '%s' from %s is awaiting confirm or rollback", name, item.PendingUpgrade.FromVersion)
+	}
+	// pg_dumpall skips databases that refuse connections, which snapshots do.
+	if len(item.Snapshots) > 0 {
+		return model.UpgradeResponse{}, conflict("database '%s' has snapshots; delete them before upgrading", name)
+	}
+
+	from, err := strconv.Atoi(item.PostgresVersion)
+	if err != nil {
+		return model.UpgradeResponse{}, fmt.Errorf("invalid postgres version '%s' for '%s'", item.PostgresVersion, name)
+	}
+	if err := u.Config.CheckVersion(req.Version); err != nil {
+		return model.UpgradeResponse{}, invalidField("version", "%w", err)
+	}
+	if req.Version <= from {
+		return model.UpgradeResponse{}, invalidField("version", "target version must be newer than current version %d", from)
+	}
+
+	target := item
+	target.PostgresVersion = strconv.Itoa(req.Version)
+	target.VolumeName = fmt.Sprintf("pgdb-%s-pg%d", name, req.Version)
+
+	targetImage, err := u.Config.Image(target.PostgresVersion, target.Flavor)
+	if err != nil {
+		return model.UpgradeResponse{}, invalidField("version", "%w", err)
+	}
+	currentImage, err := instanceImage(u.Config, item)
+	if err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	if err := u.Docker.CreateVolume(target.VolumeName); err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	blocked, err := blockLogins(u.Docker, item)
+	if err != nil {
+		_ = u.Docker.RemoveVolume(target.VolumeName)
+		return model.UpgradeResponse{}, err
+	}
+
+	if err := u.restoreIntoVolume(item, target, targetImage, blocked); err != nil {
+		_ = allowLogins(u.Docker, item, blocked)
+		_ = u.Docker.RemoveVolume(target.VolumeName)
+		return model.UpgradeResponse{}, err
+	}
+
+	if err := u.Docker.RemoveContainerForce(item.ContainerID); err != nil {
+		_ = allowLogins(u.Docker, item, blocked)
+		_ = u.Docker.RemoveVolume(target.VolumeName)
+		return model.UpgradeResponse{}, err
+	}
+
+	containerID, err := startInstance(u.Docker, target, targetImage)
+	if err != nil {
+		_ = u.Docker.RemoveVolume(target.VolumeName)
+		return model.UpgradeResponse{}, u.restorePrevious(r, idx, item, currentImage, blocked, fmt.Errorf("start upgraded container: %w", err))
+	}
+
+	target.ContainerID = containerID
+	target.ImageDigest = imageDigest(u.Docker, targetImage)
+	target.PendingUpgrade = &model.PendingUpgrade{
+		FromVersion:         item.PostgresVersion,
+		PreviousVolume:      item.VolumeName,
+		PreviousImageDigest: item.ImageDigest,
+		BlockedRoles:        blocked,
+		UpgradedAt:          util.NowRFC3339(),
+	}
+	r.Items[idx] = target
+	if err := registry.Save(u.RegistryPath, r); err != nil {
+		// Without the pending upgrade on record, Confirm and Rollback could
+		// not find the old volume, so go back to it now.
+		_ = u.Docker.StopContainer(containerID)
+		_ = u.Docker.RemoveContainerForce(containerID)
+		_ = u.Docker.RemoveVolume(target.VolumeName)
+		return model.UpgradeResponse{}, u.restorePrevious(r, idx, item, currentImage, blocked, err)
+	}
+
+	return model.UpgradeResponse{
+		Name:           name,
+		State:          UpgradePendingConfirmation,
+		FromVersion:    item.PostgresVersion,
+		ToVersion:      target.PostgresVersion,
+		PreviousVolume: item.VolumeName,
+	}, nil
+}
+
+// restorePrevious starts item again on its own volume after its container
+// was removed for a swap that failed with cause, and gives the blocked
+// roles their logins back. The returned error wraps cause and says whether
+// the database is back on its previous version.
+func (u *Upgrader) restorePrevious(r model.Registry, idx int, item model.DBInstance, image string, blocked []string, cause error) error {
+	containerID, err := startInstance(u.Docker, item, image)
+	if err != nil {
+		return fmt.Errorf("%w; restarting version %s also failed, the database is down: %w", cause, item.PostgresVersion, err)
+	}
+	item.ContainerID = containerID
+	r.Items[idx] = item
+	if err := registry.Save(u.RegistryPath, r); err != nil {
+		return fmt.Errorf("%w; version %s was restarted but not recorded: %w", cause, item.PostgresVersion, err)
+	}
+	if err := allowLogins(u.Docker, item, blocked); err != nil {
+		return fmt.Errorf("%w; rolled back to %s, but logins are still blocked: %w", cause, item.PostgresVersion, err)
+	}
+	return fmt.Errorf("%w (rolled back to %s)", cause, item.PostgresVersion)
+}
+
+// blockLogins takes LOGIN from every role but the admin role and ends all
+// other sessions, so item is not written to while it is dumped and
+// swapped. It returns the roles to hand to allowLogins afterwards.
+// ALLOW_CONNECTIONS cannot be used instead: pg_dumpall skips databases
+// that refuse connections.
+func blockLogins(d *docker.Client, item model.DBInstance) ([]string, error) {
+	var rows []struct {
+		Role string `json:"rolname"`
+	}
+	const query = `SELECT rolname FROM pg_roles WHERE rolcanlogin AND rolname <> current_user AND rolname NOT LIKE 'pg\_%' ORDER BY rolname`
+	if err := queryJSON(d, item, query, &rows); err != nil {
+		return nil, fmt.Errorf("list login roles: %w", err)
+	}
+
+	roles := make([]string, 0, len(rows))
+	var sql strings.Builder
+	for _, row := range rows {
+		roles = append(roles, row.Role)
+		fmt.Fprintf(&sql, "ALTER ROLE %s NOLOGIN; ", quoteIdent(row.Role))
+	}
+	sql.WriteString("SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND usename <> current_user")
+	if _, err := execSQLOn(d, item, "postgres", sql.String()); err != nil {
+		_ = allowLogins(d, item, roles)
+		return nil, fmt.Errorf("block logins: %w", err)
+	}
+	return roles, nil
+}
+
+// allowLogins gives LOGIN back to the roles blockLogins took it from.
+func allowLogins(d *docker.Client, item model.DBInstance, roles []string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	var sql strings.Builder
+	for _, role := range roles {
+		fmt.Fprintf(&sql, "ALTER ROLE %s LOGIN; ", quoteIdent(role))
+	}
+	if _, err := execSQLOn(d, item, "postgres", sql.String()); err != nil {
+		return fmt.Errorf("allow logins: %w", err)
+	}
+	return nil
+}
+
+// restoreIntoVolume initializes target's volume with a staging container,
+// restores a full dump of item into it and runs the post-upgrade checks.
+// The dump carries the logins blocked on item; they are allowed again in
+// the new cluster only. The staging container is always removed; item's
+// container is untouched.
+func (u *Upgrader) restoreIntoVolume(item, target model.DBInstance, targetImage string, blocked []string) error {
+	staging := target
+	staging.Name = target.Name + "-upgrade"
+	staging.HostPort = 0
+	staging.DB = "postgres"
+
+	stagingID, err := startInstance(u.Docker, staging, targetImage)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = u.Docker.RemoveContainerForce(stagingID) }()
+
+	// The bootstrap role already exists in the staging cluster, so psql runs
+	// without ON_ERROR_STOP and every other error fails the restore.
+	out, err := u.Docker.PipeExec(
+		item.ContainerID, []string{"pg_dumpall", "-U", adminRole(item)},
+		stagingID, []string{"psql", "-q", "-U", adminRole(item), "-d", "postgres"},
+	)
+	if err == nil {
+		err = restoreErrors(out, adminRole(item))
+	}
+	if err != nil {
+		return fmt.Errorf("restore dump into version %s: %w", target.PostgresVersion, err)
+	}
+
+	staging.ContainerID = stagingID
+	staging.DB = item.DB
+	if err := verifyUpgrade(u.Docker, item, staging); err != nil {
+		return fmt.Errorf("post-upgrade checks failed, database left on version %s: %w", item.PostgresVersion, err)
+	}
+
+	// postgresql.auto.conf is not part of the dump; write the stored
+	// parameters into the new cluster so the final container starts with them.
+	staging.Parameters = nil
+	if err := applyParameters(u.Docker, staging, stringParams(item.Parameters)); err != nil {
+		return fmt.Errorf("apply parameters on version %s: %w", target.PostgresVersion, err)
+	}
+	if err := allowLogins(u.Docker, staging, blocked); err != nil {
+		return err
+	}
+
+	return u.Docker.StopContainer(stagingID)
+}
+
+// restoreErrors returns the errors psql reported while restoring a
+// pg_dumpall, except the CREATE ROLE of the bootstrap role, which the new
+// cluster already has.
+func restoreErrors(out, bootstrapRole string) error {
+	expected := `ERROR:  role "` + bootstrapRole + `" already exists`
+	var errs []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "ERROR:") && !strings.HasSuffix(line, expected) {
+			errs = append(errs, strings.TrimSpace(line))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d statements failed: %s", len(errs), strings.Join(errs[:min(len(errs), 5)], "; "))
+	}
+	return nil
+}
+
+func verifyUpgrade(d *docker.Client, before, after model.DBInstance) error {
+	versionNum, err := execSQL(d, after, "SHOW server_version_num")
+	if err != nil {
+		return err
+	}
+	num, err := strconv.Atoi(versionNum)
+	if err != nil {
+		return fmt.Errorf("unexpected server_version_num '%s'", versionNum)
+	}
+	if strconv.Itoa(num/10000) != after.PostgresVersion {
+		return fmt.Errorf("server reports version %d, expected %s", num/10000, after.PostgresVersion)
+	}
+
+	want, err := tableRowCounts(d, before)
+	if err != nil {
+		return err
+	}
+	got, err := tableRowCounts(d, after)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for table, rows := range want {
+		if gotRows, ok := got[table]; !ok {
+			mismatches = append(mismatches, table+" missing")
+		} else if gotRows != rows {
+			mismatches = append(mismatches, fmt.Sprintf("%s has %d rows, expected %d", table, gotRows, rows))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%s", strings.Join(mismatches, "; "))
+	}
+
+	return nil
+}
+
+func tableRowCounts(d *docker.Client, item model.DBInstance) (map[string]int64, error) {
+	const query = `SELECT table_schema || '.' || table_name AS "table",
+		(xpath('/row/c/text()', query_to_xml(format('SELECT count(*) AS c FROM %I.%I', table_schema, table_name), false, true, '')))[1]::text::bigint AS "rows"
+		FROM information_schema.tables
+		WHERE table_type = 'BASE TABLE' AND table_schema NOT IN ('pg_catalog', 'information_schema')`
+
+	var rows []struct {
+		Table string `json:"table"`
+		Rows  int64  `json:"rows"`
+	}
+	if err := queryJSON(d, item, query, &rows); err != nil {
+		return nil, fmt.Errorf("count table rows: %w", err)
+	}
+
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Table] = row.Rows
+	}
+	return counts, nil
+}
+
+// Confirm keeps the upgraded database and deletes the pre-upgrade volume.
+func (u *Upgrader) Confirm(ctx context.Context, name string) (model.UpgradeResponse, error) {
+	u = u.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, u.LockPath)
+	if err != nil {
+		return model.UpgradeResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(u.RegistryPath)
+	if err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.UpgradeResponse{}, databaseNotFound(name)
+	}
+	pending := item.PendingUpgrade
+	if pending == nil {
+		return model.UpgradeResponse{}, conflict("database '%s' has no pending upgrade", name)
+	}
+
+	if err := u.Docker.RemoveVolume(pending.PreviousVolume); err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	item.PendingUpgrade = nil
+	r.Items[idx] = item
+	if err := registry.Save(u.RegistryPath, r); err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	return model.UpgradeResponse{
+		Name:        name,
+		State:       UpgradeConfirmed,
+		FromVersion: pending.FromVersion,
+		ToVersion:   item.PostgresVersion,
+	}, nil
+}
+
+// Rollback restarts the database on its pre-upgrade volume and version and
+// deletes the upgraded volume. Writes made since the upgrade are lost. The
+// pre-upgrade volume still has the logins blocked for the upgrade, so they
+// are allowed again.
+func (u *Upgrader) Rollback(ctx context.Context, name string) (model.UpgradeResponse, error) {
+	u = u.traced(ctx)
+
+	unlock, err := registry.AcquireLock(ctx, u.LockPath)
+	if err != nil {
+		return model.UpgradeResponse{}, err
+	}
+	defer func() { _ = unlock() }()
+
+	r, err := registry.Load(u.RegistryPath)
+	if err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	item, idx := registry.FindByName(r, name)
+	if idx < 0 {
+		return model.UpgradeResponse{}, databaseNotFound(name)
+	}
+	pending := item.PendingUpgrade
+	if pending == nil {
+		return model.UpgradeResponse{}, conflict("database '%s' has no pending upgrade", name)
+	}
+
+	previous := item
+	previous.PostgresVersion = pending.FromVersion
+	previous.VolumeName = pending.PreviousVolume
+	previous.ImageDigest = pending.PreviousImageDigest
+	previous.PendingUpgrade = nil
+
+	previousImage, err := instanceImage(u.Config, previous)
+	if err != nil {
+		return model.UpgradeResponse{}, err
+	}
+	currentImage, err := instanceImage(u.Config, item)
+	if err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	if err := u.Docker.RemoveContainerForce(item.ContainerID); err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	containerID, err := startInstance(u.Docker, previous, previousImage)
+	if err != nil {
+		if restoredID, restartErr := startInstance(u.Docker, item, currentImage); restartErr == nil {
+			item.ContainerID = restoredID
+			r.Items[idx] = item
+			_ = registry.Save(u.RegistryPath, r)
+		}
+		return model.UpgradeResponse{}, fmt.Errorf("start previous version %s: %w", pending.FromVersion, err)
+	}
+
+	previous.ContainerID = containerID
+	previous.ImageDigest = imageDigest(u.Docker, previousImage)
+	r.Items[idx] = previous
+	if err := registry.Save(u.RegistryPath, r); err != nil {
+		return model.UpgradeResponse{}, err
+	}
+	if err := allowLogins(u.Docker, previous, pending.BlockedRoles); err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	if err := u.Docker.RemoveVolume(item.VolumeName); err != nil {
+		return model.UpgradeResponse{}, err
+	}
+
+	return model.UpgradeResponse{
+		Name:        name,
+		State:       UpgradeRolledBack,
+		FromVersion: item.PostgresVersion,
+		ToVersion:   previous.PostgresVersion,
+	}, nil
+}
@@ -2,21 +2,46 @@ package docker
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"pgdb/daemon/internal/tracing"
 )
 
-type Client struct{}
+type Client struct {
+	ctx context.Context
+}
 
 func NewClient() *Client {
 	return &Client{}
 }
 
-func (c *Client) EnsureAvailable() error {
+// WithContext returns a client whose calls are recorded as spans of the
+// trace in ctx. ctx only carries the trace; it does not cancel commands.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	return &Client{ctx: ctx}
+}
+
+// trace starts a span for a docker call if the client has a traced
+// context. The returned func ends it with *err.
+func (c *Client) trace(name string, err *error, attrs ...any) func() {
+	if tracing.FromContext(c.ctx) == nil {
+		return func() {}
+	}
+	_, span := tracing.Start(c.ctx, name, attrs...)
+	return func() { span.End(*err) }
+}
+
+func (c *Client) EnsureAvailable() (err error) {
+	defer c.trace("docker version", &err)()
+
 	cmd := exec.Command("docker", "version", "--format", "{{.Server.Version}}")
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("docker not available: %w: %s", err, strings.TrimSpace(string(out)))
@@ -24,7 +49,9 @@ func (c *Client) EnsureAvailable() error {
 	return nil
 }
 
-func (c *Client) CreateVolume(name string) error {
+func (c *Client) CreateVolume(name string) (err error) {
+	defer c.trace("docker volume create", &err, "docker.volume", name)()
+
 	cmd := exec.Command("docker", "volume", "create", name)
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("create volume %s: %w: %s", name, err, strings.TrimSpace(string(out)))
@@ -32,7 +59,9 @@ func (c *Client) CreateVolume(name string) error {
 	return nil
 }
 
-func (c *Client) RemoveVolume(name string) error {
+func (c *Client) RemoveVolume(name string) (err error) {
+	defer c.trace("docker volume rm", &err, "docker.volume", name)()
+
 	cmd := exec.Command("docker", "volume", "rm", name)
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("remove volume %s: %w: %s", name, err, strings.TrimSpace(string(out)))
@@ -40,7 +69,9 @@ func (c *Client) RemoveVolume(name string) error {
 	return nil
 }
 
-func (c *Client) RunPostgres(opts RunPostgresOptions) (string, error) {
+func (c *Client) RunPostgres(opts RunPostgresOptions) (_ string, err error) {
+	defer c.trace("docker run", &err, "docker.container", opts.ContainerName, "docker.image", opts.Image)()
+
 	args := []string{
 		"run", "-d",
 		"--name", opts.ContainerName,
@@ -49,9 +80,14 @@ func (c *Client) RunPostgres(opts RunPostgresOptions) (string, error) {
 		"-e", "POSTGRES_USER=" + opts.User,
 		"-e", "POSTGRES_PASSWORD=" + opts.Password,
 		"-v", opts.VolumeName + ":/var/lib/postgresql/data",
-		"-p", strconv.Itoa(opts.HostPort) + ":5432",
-		"postgres:" + opts.PostgresVersion,
 	}
+	if opts.InitdbArgs != "" {
+		args = append(args, "-e", "POSTGRES_INITDB_ARGS="+opts.InitdbArgs)
+	}
+	if opts.HostPort > 0 {
+		args = append(args, "-p", strconv.Itoa(opts.HostPort)+":5432")
+	}
+	args = append(args, opts.Image)
 
 	cmd := exec.Command("docker", args...)
 	out, err := cmd.CombinedOutput()
@@ -68,16 +104,72 @@ func (c *Client) RunPostgres(opts RunPostgresOptions) (string, error) {
 }
 
 type RunPostgresOptions struct {
-	ContainerName   string
-	VolumeName      string
-	HostPort        int
-	DB              string
-	User            string
-	Password        string
-	PostgresVersion string
+	ContainerName string
+	VolumeName    string
+	HostPort      int
+	DB            string
+	User          string
+	Password      string
+	Image         string
+	InitdbArgs    string
+}
+
+func (c *Client) PullImage(ref string) (err error) {
+	defer c.trace("docker pull", &err, "docker.image", ref)()
+
+	cmd := exec.Command("docker", "pull", "--quiet", ref)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pull image %s: %w: %s", ref, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ImageDigest returns the repo digest reference (repo@sha256:...) of a local
+// image, falling back to the image ID for images without a registry digest.
+func (c *Client) ImageDigest(ref string) (_ string, err error) {
+	defer c.trace("docker image inspect", &err, "docker.image", ref)()
+
+	cmd := exec.Command("docker", "image", "inspect", "--format", "{{if .RepoDigests}}{{index .RepoDigests 0}}{{else}}{{.Id}}{{end}}", ref)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("inspect image %s: %w: %s", ref, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (c *Client) StopContainer(containerID string) (err error) {
+	defer c.trace("docker stop", &err, "docker.container", containerID)()
+
+	cmd := exec.Command("docker", "stop", containerID)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("stop container %s: %w: %s", containerID, err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
 
-func (c *Client) RemoveContainerForce(containerID string) error {
+func (c *Client) RenameContainer(containerID, name string) (err error) {
+	defer c.trace("docker rename", &err, "docker.container", containerID, "docker.name", name)()
+
+	cmd := exec.Command("docker", "rename", containerID, name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("rename container %s: %w: %s", containerID, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (c *Client) RestartContainer(containerID string) (err error) {
+	defer c.trace("docker restart", &err, "docker.container", containerID)()
+
+	cmd := exec.Command("docker", "restart", containerID)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("restart container %s: %w: %s", containerID, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (c *Client) RemoveContainerForce(containerID string) (err error) {
+	defer c.trace("docker rm", &err, "docker.container", containerID)()
+
 	cmd := exec.Command("docker", "rm", "-f", containerID)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
@@ -90,17 +182,32 @@ func (c *Client) RemoveContainerForce(containerID string) error {
 	return nil
 }
 
-func (c *Client) WaitReady(containerID, user, db string, timeout time.Duration) error {
+// WaitReady polls pg_isready once a second. When traced, each failed poll
+// is an event on the span, so slow starts show how long Postgres took.
+func (c *Client) WaitReady(containerID, user, db string, timeout time.Duration) (err error) {
+	var span *tracing.Span
+	if tracing.FromContext(c.ctx) != nil {
+		_, span = tracing.Start(c.ctx, "docker wait ready", "docker.container", containerID, "timeout", timeout.String())
+	}
+	polls := 0
+	defer func() {
+		span.SetAttr("polls", polls)
+		span.End(err)
+	}()
+
 	deadline := time.Now().Add(timeout)
 	for {
 		if time.Now().After(deadline) {
 			return fmt.Errorf("postgres did not become ready before %s", timeout)
 		}
 
+		polls++
 		cmd := exec.Command("docker", "exec", containerID, "pg_isready", "-U", user, "-d", db)
-		if err := cmd.Run(); err == nil {
+		out, err := cmd.CombinedOutput()
+		if err == nil {
 			return nil
 		}
+		span.AddEvent("not ready", "poll", polls, "output", strings.TrimSpace(string(out)))
 
 		time.Sleep(1 * time.Second)
 	}
@@ -114,14 +221,249 @@ func IsPortAllocationError(err error) bool {
 	return strings.Contains(msg, "port is already allocated") || strings.Contains(msg, "address already in use")
 }
 
-func (c *Client) ExecSQL(containerID, user, db, sql string) (string, error) {
-	cmd := exec.Command("docker", "exec", containerID, "psql", "-U", user, "-d", db, "-t", "-A", "-c", sql)
+// IsUnavailable reports whether err means docker itself could not be
+// reached, as opposed to a failed command.
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Cannot connect to the Docker daemon") || strings.Contains(msg, "Is the docker daemon running") ||
+		strings.Contains(msg, "error during connect")
+}
+
+// PipeExec runs srcArgs in one container with its output piped into dstArgs
+// in another, and returns the output of dstArgs, stdout and stderr merged.
+func (c *Client) PipeExec(srcContainerID string, srcArgs []string, dstContainerID string, dstArgs []string) (_ string, err error) {
+	defer c.trace("docker exec pipe", &err, "docker.container", srcContainerID, "docker.target_container", dstContainerID,
+		"docker.command", srcArgs[0]+" | "+dstArgs[0])()
+
+	src := exec.Command("docker", append([]string{"exec", srcContainerID}, srcArgs...)...)
+	dst := exec.Command("docker", append([]string{"exec", "-i", dstContainerID}, dstArgs...)...)
+
+	pipe, err := src.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("pipe exec: %w", err)
+	}
+	dst.Stdin = pipe
+
+	var srcErr bytes.Buffer
+	var dstOut bytes.Buffer
+	src.Stderr = &srcErr
+	dst.Stdout = &dstOut
+	dst.Stderr = &dstOut
+
+	if err := src.Start(); err != nil {
+		return "", fmt.Errorf("pipe exec: start %s: %w", srcArgs[0], err)
+	}
+	if err := dst.Run(); err != nil {
+		_ = src.Process.Kill()
+		_ = src.Wait()
+		return "", fmt.Errorf("pipe exec: %s failed: %w: %s", dstArgs[0], err, strings.TrimSpace(dstOut.String()))
+	}
+	if err := src.Wait(); err != nil {
+		return "", fmt.Errorf("pipe exec: %s failed: %w: %s", srcArgs[0], err, strings.TrimSpace(srcErr.String()))
+	}
+	return dstOut.String(), nil
+}
+
+// ExecSQL runs sql with psql and returns its unaligned output. Errors
+// reported by the server are returned as *SQLError.
+func (c *Client) ExecSQL(containerID, user, db, sql string) (_ string, err error) {
+	defer c.trace("docker exec psql", &err, "docker.container", containerID, "db.name", db, "db.user", user)()
+
+	cmd := exec.Command("docker", "exec", containerID, "psql", "-U", user, "-d", db, "-v", "VERBOSITY=verbose", "-t", "-A", "-c", sql)
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
+		if sqlErr := parseSQLError(stderr.String()); sqlErr != nil {
+			return "", fmt.Errorf("exec sql: %w", sqlErr)
+		}
 		return "", fmt.Errorf("exec sql: %w: %s", err, strings.TrimSpace(stderr.String()))
 	}
 	return strings.TrimSpace(stdout.String()), nil
 }
+
+// SQLError is an error reported by the server, with its SQLSTATE.
+type SQLError struct {
+	State   string
+	Message string
+}
+
+func (e *SQLError) Error() string { return e.Message }
+
+// SQLState returns the SQLSTATE of a statement ExecSQL ran, or "" if err
+// did not come from the server.
+func SQLState(err error) string {
+	var sqlErr *SQLError
+	if errors.As(err, &sqlErr) {
+		return sqlErr.State
+	}
+	return ""
+}
+
+// sqlErrorRe matches the first line of a server error at psql's verbose
+// verbosity, which puts the SQLSTATE after the severity.
+var sqlErrorRe = regexp.MustCompile(`^((?:ERROR|FATAL|PANIC):\s+)([0-9A-Z]{5}): `)
+
+// parseSQLError extracts the server error from psql's verbose stderr,
+// dropping the SQLSTATE prefix and the source location so the message
+// reads as at the default verbosity.
+func parseSQLError(stderr string) *SQLError {
+	var state string
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		if strings.HasPrefix(line, "LOCATION:") {
+			continue
+		}
+		if m := sqlErrorRe.FindStringSubmatch(line); m != nil && state == "" {
+			state = m[2]
+			line = m[1] + line[len(m[0]):]
+		}
+		lines = append(lines, line)
+	}
+	if state == "" {
+		return nil
+	}
+	return &SQLError{State: state, Message: strings.Join(lines, "\n")}
+}
+
+// Exec runs a command in the container and returns its standard output.
+func (c *Client) Exec(containerID string, args ...string) (_ []byte, err error) {
+	defer c.trace("docker exec", &err, "docker.container", containerID, "docker.command", args[0])()
+
+	cmd := exec.Command("docker", append([]string{"exec", containerID}, args...)...)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("exec %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Logs streams the container's output, stdout and stderr merged, with each
+// line prefixed by its RFC3339 timestamp. A zero since or negative tail
+// means no limit. The stream ends when the output does, or, with follow,
+// when ctx is done.
+func (c *Client) Logs(ctx context.Context, containerID string, tail int, since time.Time, follow bool) io.ReadCloser {
+	args := []string{"logs", "--timestamps"}
+	if tail >= 0 {
+		args = append(args, "--tail", strconv.Itoa(tail))
+	}
+	if !since.IsZero() {
+		args = append(args, "--since", since.UTC().Format(time.RFC3339Nano))
+	}
+	if follow {
+		args = append(args, "--follow")
+	}
+	args = append(args, containerID)
+
+	pr, pw := io.Pipe()
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		_ = pw.CloseWithError(fmt.Errorf("docker logs: %w", err))
+		return pr
+	}
+	go func() {
+		err := cmd.Wait()
+		if err != nil && ctx.Err() == nil {
+			err = fmt.Errorf("docker logs: %w", err)
+		} else {
+			err = nil
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+type Container struct {
+	ID    string
+	Name  string
+	State string
+}
+
+// ListContainers returns all containers, running or not, whose name starts
+// with prefix.
+func (c *Client) ListContainers(prefix string) (_ []Container, err error) {
+	defer c.trace("docker ps", &err, "docker.prefix", prefix)()
+
+	cmd := exec.Command("docker", "ps", "-a", "--no-trunc", "--filter", "name=^"+prefix, "--format", "{{.ID}}\t{{.Names}}\t{{.State}}")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("list containers: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	var containers []Container
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		containers = append(containers, Container{ID: fields[0], Name: fields[1], State: fields[2]})
+	}
+	return containers, nil
+}
+
+type ContainerStats struct {
+	CPUPercent  float64
+	MemoryBytes float64
+}
+
+// Stats samples CPU and memory usage of running containers, keyed by full
+// container ID. docker stats takes a second or two to sample.
+func (c *Client) Stats(containerIDs []string) (_ map[string]ContainerStats, err error) {
+	defer c.trace("docker stats", &err, "docker.containers", len(containerIDs))()
+
+	out := map[string]ContainerStats{}
+	if len(containerIDs) == 0 {
+		return out, nil
+	}
+
+	args := append([]string{"stats", "--no-stream", "--no-trunc", "--format", "{{.ID}}\t{{.CPUPerc}}\t{{.MemUsage}}"}, containerIDs...)
+	raw, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("container stats: %w: %s", err, strings.TrimSpace(string(raw)))
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		cpu, _ := strconv.ParseFloat(strings.TrimSuffix(fields[1], "%"), 64)
+		used, _, _ := strings.Cut(fields[2], "/")
+		out[fields[0]] = ContainerStats{CPUPercent: cpu, MemoryBytes: parseByteSize(strings.TrimSpace(used))}
+	}
+	return out, nil
+}
+
+// parseByteSize parses sizes as docker stats prints them, e.g. "12.5MiB".
+func parseByteSize(s string) float64 {
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"kB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"B", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+			if err != nil {
+				return 0
+			}
+			return v * u.factor
+		}
+	}
+	return 0
+}
@@ -0,0 +1,205 @@
+// Package events keeps the daemon's lifecycle events in an append-only
+// JSON-lines file and fans them out to subscribers. Event IDs increase
+// monotonically across restarts, so clients can resume a stream.
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DeployStarted   = "deploy.started"
+	DeploySucceeded = "deploy.succeeded"
+	DeployFailed    = "deploy.failed"
+	Destroyed       = "database.destroyed"
+	Restarted       = "database.restarted"
+	HealthChanged   = "database.health_changed"
+	DiskHigh        = "database.disk_high"
+	Drift           = "reconciler.drift"
+	WebhookTest     = "webhook.test"
+)
+
+// Types lists the event types the daemon publishes.
+var Types = []string{DeployStarted, DeploySucceeded, DeployFailed, Destroyed, Restarted, HealthChanged, DiskHigh, Drift}
+
+// retained is how many events are kept for replay. The file is rewritten
+// with the newest ones once it holds twice as many.
+const retained = 10000
+
+type Event struct {
+	ID   int64          `json:"id"`
+	Type string         `json:"type"`
+	Time string         `json:"time"`
+	Name string         `json:"name,omitempty"`
+	Data map[string]any `json:"data,omitempty"`
+}
+
+type Log struct {
+	path   string
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	events  []Event
+	written int
+	nextID  int64
+	subs    map[chan Event]struct{}
+}
+
+// Open loads the events kept in path, creating the file if needed. Events
+// that cannot be written to the file are still delivered and logged to
+// logger.
+func Open(path string, logger *slog.Logger) (*Log, error) {
+	l := &Log{path: path, logger: logger, nextID: 1, subs: map[chan Event]struct{}{}}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open event log: %w", err)
+	}
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e Event
+			// A torn last line from a crash is skipped.
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				continue
+			}
+			l.events = append(l.events, e)
+			l.written++
+			if e.ID >= l.nextID {
+				l.nextID = e.ID + 1
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read event log: %w", err)
+		}
+	}
+	if len(l.events) > retained {
+		l.events = l.events[len(l.events)-retained:]
+	}
+	return l, nil
+}
+
+// Publish records an event and delivers it to subscribers. Subscribers
+// that are not keeping up miss live events and must resume from the log.
+// A nil Log discards events, so services can run without one.
+func (l *Log) Publish(typ, name string, data map[string]any) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := Event{ID: l.nextID, Type: typ, Time: time.Now().UTC().Format(time.RFC3339Nano), Name: name, Data: data}
+	l.nextID++
+	l.events = append(l.events, e)
+	if len(l.events) > retained {
+		l.events = l.events[len(l.events)-retained:]
+	}
+	if err := l.persist(e); err != nil {
+		l.logger.Error("event log: persist event failed", "id", e.ID, "type", typ, "error", err)
+	}
+
+	for ch := range l.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (l *Log) persist(e Event) error {
+	if l.written >= 2*retained {
+		return l.compact()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	l.written++
+	return nil
+}
+
+// compact rewrites the file with the retained events, which already
+// include the one being published.
+func (l *Log) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".events-*.jsonl")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, e := range l.events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			_ = tmp.Close()
+			return err
+		}
+		_, _ = w.Write(append(b, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return err
+	}
+	l.written = len(l.events)
+	return nil
+}
+
+// Since returns the retained events with an ID greater than id.
+func (l *Log) Since(id int64) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, e := range l.events {
+		if e.ID > id {
+			return append([]Event(nil), l.events[i:]...)
+		}
+	}
+	return nil
+}
+
+// LastID returns the ID of the newest event, or 0 if there is none.
+func (l *Log) LastID() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nextID - 1
+}
+
+// Subscribe returns a channel receiving events published from now on and a
+// function that ends the subscription.
+func (l *Log) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 256)
+	l.mu.Lock()
+	l.subs[ch] = struct{}{}
+	l.mu.Unlock()
+
+	return ch, func() {
+		l.mu.Lock()
+		delete(l.subs, ch)
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,199 @@
+// Package metrics implements the small subset of the Prometheus text
+// exposition format pgdbd needs: labelled counters and histograms kept in
+// memory, plus helpers for gauges computed at scrape time.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	HTTPRequests = NewCounterVec("pgdbd_http_requests_total",
+		"HTTP requests handled, by route, method and status code.", "route", "method", "status")
+	HTTPDuration = NewHistogramVec("pgdbd_http_request_duration_seconds",
+		"HTTP request latency by route.", []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30, 120}, "route")
+	OperationDuration = NewHistogramVec("pgdbd_operation_duration_seconds",
+		"Duration of deploys and destroys, by result.", []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120}, "operation", "result")
+	LockWait = NewHistogramVec("pgdbd_registry_lock_wait_seconds",
+		"Time spent waiting for the registry lock.", []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 30, 120})
+)
+
+// WriteDaemon writes the daemon's own metrics.
+func WriteDaemon(w io.Writer) {
+	HTTPRequests.Write(w)
+	HTTPDuration.Write(w)
+	OperationDuration.Write(w)
+	LockWait.Write(w)
+}
+
+// ObserveOperation records the duration of an operation that started at
+// start, labelled by whether *err is nil. It is meant to be deferred.
+func ObserveOperation(operation string, start time.Time, err *error) {
+	result := "ok"
+	if *err != nil {
+		result = "error"
+	}
+	OperationDuration.Observe(time.Since(start).Seconds(), operation, result)
+}
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) Write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	WriteHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, le := range h.buckets {
+		if value <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) Write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	WriteHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		var values []string
+		if len(h.labels) > 0 {
+			values = strings.Split(key, "\x00")
+		}
+		names := append(append([]string{}, h.labels...), "le")
+		for i, le := range h.buckets {
+			labels := formatLabels(names, append(append([]string{}, values...), formatValue(le)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, append(append([]string{}, values...), "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+// WriteHeader writes the HELP and TYPE lines of a metric family.
+func WriteHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// WriteSample writes one sample; labels alternate names and values.
+func WriteSample(w io.Writer, name string, value float64, labels ...string) {
+	names := make([]string, 0, len(labels)/2)
+	values := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		names = append(names, labels[i])
+		values = append(values, labels[i+1])
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(names, values), formatValue(value))
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts[i] = name + `="` + escapeLabel(value) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
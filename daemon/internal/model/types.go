@@ -2,26 +2,70 @@ package model
 
 type Registry struct {
 	Items []DBInstance `json:"items"`
+	// Pool holds ready instances waiting to be claimed by a deploy. They
+	// have no name, host or creation time yet.
+	Pool []DBInstance `json:"pool,omitempty"`
 }
 
 type DBInstance struct {
-	Name            string `json:"name"`
-	ContainerID     string `json:"container_id"`
-	VolumeName      string `json:"volume_name"`
-	Host            string `json:"host"`
-	HostPort        int    `json:"host_port"`
-	DB              string `json:"db"`
-	User            string `json:"user"`
-	Password        string `json:"password"`
-	CreatedAt       string `json:"created_at"`
-	PostgresVersion string `json:"postgres_version"`
-	SizeGB          int    `json:"size_gb,omitempty"`
+	Name               string              `json:"name"`
+	ContainerID        string              `json:"container_id"`
+	VolumeName         string              `json:"volume_name"`
+	Host               string              `json:"host"`
+	HostPort           int                 `json:"host_port"`
+	DB                 string              `json:"db"`
+	User               string              `json:"user"`
+	Password           string              `json:"password"`
+	AdminUser          string              `json:"admin_user,omitempty"`
+	AdminPassword      string              `json:"admin_password,omitempty"`
+	CreatedAt          string              `json:"created_at"`
+	PostgresVersion    string              `json:"postgres_version"`
+	SizeGB             int                 `json:"size_gb,omitempty"`
+	MaskRules          []MaskRule          `json:"mask_rules,omitempty"`
+	ClonedFrom         string              `json:"cloned_from,omitempty"`
+	PendingUpgrade     *PendingUpgrade     `json:"pending_upgrade,omitempty"`
+	ImageDigest        string              `json:"image_digest,omitempty"`
+	ImageUpdatedAt     string              `json:"image_updated_at,omitempty"`
+	MaintenanceWindow  string              `json:"maintenance_window,omitempty"`
+	Flavor             string              `json:"flavor,omitempty"`
+	Parameters         map[string]string   `json:"parameters,omitempty"`
+	Initdb             *InitdbOptions      `json:"initdb,omitempty"`
+	Roles              []Role              `json:"roles,omitempty"`
+	OwnerRole          string              `json:"owner_role,omitempty"`
+	RetiredCredentials []RetiredCredential `json:"retired_credentials,omitempty"`
+	DynamicCredentials []DynamicCredential `json:"dynamic_credentials,omitempty"`
+	Databases          []LogicalDatabase   `json:"databases,omitempty"`
+	TTL                string              `json:"ttl,omitempty"`
+	ExpiresAt          string              `json:"expires_at,omitempty"`
+	Snapshots          []Snapshot          `json:"snapshots,omitempty"`
+}
+
+type InitdbOptions struct {
+	Encoding       string `json:"encoding,omitempty"`
+	Locale         string `json:"locale,omitempty"`
+	LocaleProvider string `json:"locale_provider,omitempty"`
+	ICULocale      string `json:"icu_locale,omitempty"`
+	DataChecksums  bool   `json:"data_checksums,omitempty"`
+}
+
+// PendingUpgrade records the pre-upgrade volume of a database so the upgrade
+// can be rolled back until it is confirmed.
+type PendingUpgrade struct {
+	FromVersion         string   `json:"from_version"`
+	PreviousVolume      string   `json:"previous_volume"`
+	PreviousImageDigest string   `json:"previous_image_digest,omitempty"`
+	BlockedRoles        []string `json:"blocked_roles,omitempty"`
+	UpgradedAt          string   `json:"upgraded_at"`
 }
 
 type DeployRequest struct {
-	Name    string `json:"name"`
-	SizeGB  int    `json:"size_gb"`
-	Version int    `json:"version"`
+	Name       string            `json:"name"`
+	SizeGB     int               `json:"size_gb"`
+	Version    int               `json:"version"`
+	Flavor     string            `json:"flavor"`
+	Parameters map[string]string `json:"parameters"`
+	Initdb     *InitdbOptions    `json:"initdb"`
+	TTL        string            `json:"ttl"`
 }
 
 type DeployResponse struct {
@@ -34,6 +78,8 @@ type DeployResponse struct {
 	DatabaseURL     string `json:"database_url"`
 	CreatedAt       string `json:"created_at"`
 	PostgresVersion string `json:"postgres_version"`
+	Flavor          string `json:"flavor,omitempty"`
+	ExpiresAt       string `json:"expires_at,omitempty"`
 }
 
 type StatusResponse struct {
@@ -41,15 +87,374 @@ type StatusResponse struct {
 }
 
 type StatusItem struct {
-	Name            string `json:"name"`
-	ContainerID     string `json:"container_id"`
-	VolumeName      string `json:"volume_name"`
-	Host            string `json:"host"`
-	HostPort        int    `json:"host_port"`
-	DB              string `json:"db"`
+	Name               string              `json:"name"`
+	ContainerID        string              `json:"container_id"`
+	VolumeName         string              `json:"volume_name"`
+	Host               string              `json:"host"`
+	HostPort           int                 `json:"host_port"`
+	DB                 string              `json:"db"`
+	User               string              `json:"user"`
+	Password           string              `json:"password"`
+	CreatedAt          string              `json:"created_at"`
+	PostgresVersion    string              `json:"postgres_version"`
+	DatabaseURL        string              `json:"database_url"`
+	PendingUpgrade     *PendingUpgrade     `json:"pending_upgrade,omitempty"`
+	ImageDigest        string              `json:"image_digest,omitempty"`
+	MaintenanceWindow  string              `json:"maintenance_window,omitempty"`
+	Flavor             string              `json:"flavor,omitempty"`
+	Parameters         map[string]string   `json:"parameters,omitempty"`
+	Initdb             *InitdbOptions      `json:"initdb,omitempty"`
+	RetiredCredentials []RetiredCredential `json:"retired_credentials,omitempty"`
+	Databases          []DatabaseInfo      `json:"databases,omitempty"`
+	ExpiresAt          string              `json:"expires_at,omitempty"`
+}
+
+type MaskRule struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Action string `json:"action"`
+}
+
+type MaskIssue struct {
+	Table   string `json:"table"`
+	Column  string `json:"column"`
+	Problem string `json:"problem"`
+}
+
+type MaskingRequest struct {
+	Rules []MaskRule `json:"rules"`
+}
+
+type MaskingResponse struct {
+	Name   string      `json:"name"`
+	Rules  []MaskRule  `json:"rules"`
+	Issues []MaskIssue `json:"issues"`
+}
+
+type CloneRequest struct {
+	Name   string `json:"name"`
+	SizeGB int    `json:"size_gb"`
+}
+
+type UpgradeRequest struct {
+	Version int `json:"version"`
+}
+
+type UpgradeResponse struct {
+	Name           string `json:"name"`
+	State          string `json:"state"`
+	FromVersion    string `json:"from_version"`
+	ToVersion      string `json:"to_version"`
+	PreviousVolume string `json:"previous_volume,omitempty"`
+}
+
+type ImageUpdateResponse struct {
+	Name           string `json:"name"`
+	State          string `json:"state"`
+	Image          string `json:"image"`
+	PreviousDigest string `json:"previous_digest,omitempty"`
+	Digest         string `json:"digest"`
+}
+
+type MaintenanceWindowRequest struct {
+	Window string `json:"window"`
+}
+
+type VersionsResponse struct {
+	DefaultVersion int           `json:"default_version"`
+	Items          []VersionInfo `json:"items"`
+}
+
+type VersionInfo struct {
+	Version    int      `json:"version"`
+	Image      string   `json:"image"`
+	Default    bool     `json:"default"`
+	EOL        string   `json:"eol,omitempty"`
+	Deprecated bool     `json:"deprecated"`
+	Warning    string   `json:"warning,omitempty"`
+	Flavors    []string `json:"flavors"`
+}
+
+type Extension struct {
+	Name             string  `json:"name"`
+	DefaultVersion   string  `json:"default_version"`
+	InstalledVersion *string `json:"installed_version"`
+	Comment          string  `json:"comment"`
+}
+
+type ExtensionsResponse struct {
+	Name  string      `json:"name"`
+	Items []Extension `json:"items"`
+}
+
+type CreateExtensionRequest struct {
+	Name   string `json:"name"`
+	Schema string `json:"schema"`
+}
+
+// PatchParametersRequest sets parameters to the given values; a null value
+// resets the parameter to the server default.
+type PatchParametersRequest struct {
+	Parameters map[string]*string `json:"parameters"`
+	Restart    bool               `json:"restart"`
+}
+
+type ParametersResponse struct {
+	Name           string            `json:"name"`
+	Parameters     map[string]string `json:"parameters"`
+	PendingRestart []string          `json:"pending_restart"`
+	Restarted      bool              `json:"restarted"`
+}
+
+// Role is an extra login role created from a privilege template.
+type Role struct {
+	Name      string `json:"name"`
+	Template  string `json:"template"`
+	Password  string `json:"password"`
+	CreatedAt string `json:"created_at"`
+	RotatedAt string `json:"rotated_at,omitempty"`
+}
+
+type CreateRoleRequest struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+}
+
+type RoleCredentials struct {
+	Name        string `json:"name"`
+	Template    string `json:"template"`
+	Password    string `json:"password"`
+	DatabaseURL string `json:"database_url"`
+	CreatedAt   string `json:"created_at"`
+	RotatedAt   string `json:"rotated_at,omitempty"`
+}
+
+type RolesResponse struct {
+	Name  string            `json:"name"`
+	Items []RoleCredentials `json:"items"`
+}
+
+// RetiredCredential is a previous login user that keeps working until
+// RevokeAt.
+type RetiredCredential struct {
+	User     string `json:"user"`
+	RevokeAt string `json:"revoke_at"`
+}
+
+type RotateCredentialsRequest struct {
+	GracePeriod string `json:"grace_period"`
+}
+
+type RotateCredentialsResponse struct {
+	Name             string `json:"name"`
+	User             string `json:"user"`
+	Password         string `json:"password"`
+	DatabaseURL      string `json:"database_url"`
+	PreviousUser     string `json:"previous_user"`
+	PreviousRevokeAt string `json:"previous_revoke_at"`
+}
+
+// DynamicCredential is a temporary login role. Its password is not stored.
+type DynamicCredential struct {
+	User      string `json:"user"`
+	Template  string `json:"template"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+	Sessions  int    `json:"sessions,omitempty"`
+}
+
+type IssueCredentialRequest struct {
+	Template string `json:"template"`
+	TTL      string `json:"ttl"`
+}
+
+type IssuedCredential struct {
+	Name        string `json:"name"`
+	User        string `json:"user"`
+	Password    string `json:"password"`
+	Template    string `json:"template"`
+	DatabaseURL string `json:"database_url"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+type DynamicCredentialsResponse struct {
+	Name  string              `json:"name"`
+	Items []DynamicCredential `json:"items"`
+}
+
+// LogicalDatabase is an extra database inside an instance, owned by its own
+// login role.
+type LogicalDatabase struct {
+	Name      string `json:"name"`
+	User      string `json:"user"`
+	Password  string `json:"password"`
+	CreatedAt string `json:"created_at"`
+}
+
+type CreateDatabaseRequest struct {
+	Name string `json:"name"`
+}
+
+type DatabaseInfo struct {
+	Name        string `json:"name"`
+	User        string `json:"user"`
+	Password    string `json:"password"`
+	DatabaseURL string `json:"database_url"`
+	CreatedAt   string `json:"created_at"`
+}
+
+type DatabasesResponse struct {
+	Name  string         `json:"name"`
+	Items []DatabaseInfo `json:"items"`
+}
+
+// LeaseRequest extends an ephemeral database; an empty TTL reuses the one
+// it was deployed with.
+type LeaseRequest struct {
+	TTL string `json:"ttl"`
+}
+
+type LeaseResponse struct {
+	Name      string `json:"name"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// Snapshot is a template database holding a copy of the instance's
+// database at CreatedAt.
+type Snapshot struct {
+	Name      string `json:"name"`
+	Database  string `json:"database"`
+	CreatedAt string `json:"created_at"`
+}
+
+type CreateSnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+type SnapshotsResponse struct {
+	Name  string     `json:"name"`
+	Items []Snapshot `json:"items"`
+}
+
+type ResetResponse struct {
+	Name       string `json:"name"`
+	Snapshot   string `json:"snapshot"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+type QueryStat struct {
+	QueryID     string  `json:"query_id"`
+	Database    string  `json:"database"`
+	User        string  `json:"user"`
+	Query       string  `json:"query"`
+	Calls       int64   `json:"calls"`
+	TotalTimeMS float64 `json:"total_time_ms"`
+	MeanTimeMS  float64 `json:"mean_time_ms"`
+	Rows        int64   `json:"rows"`
+}
+
+type QueriesResponse struct {
+	Name  string      `json:"name"`
+	Sort  string      `json:"sort"`
+	Items []QueryStat `json:"items"`
+}
+
+type Session struct {
+	PID             int    `json:"pid"`
+	Database        string `json:"database"`
 	User            string `json:"user"`
-	Password        string `json:"password"`
-	CreatedAt       string `json:"created_at"`
-	PostgresVersion string `json:"postgres_version"`
-	DatabaseURL     string `json:"database_url"`
+	ApplicationName string `json:"application_name"`
+	ClientAddr      string `json:"client_addr,omitempty"`
+	State           string `json:"state"`
+	WaitEventType   string `json:"wait_event_type,omitempty"`
+	WaitEvent       string `json:"wait_event,omitempty"`
+	BackendStart    string `json:"backend_start"`
+	XactStart       string `json:"xact_start,omitempty"`
+	QueryStart      string `json:"query_start,omitempty"`
+	Query           string `json:"query"`
+	BlockedBy       []int  `json:"blocked_by"`
+}
+
+type ActivityResponse struct {
+	Name  string    `json:"name"`
+	Items []Session `json:"items"`
+}
+
+// LogsRequest filters log entries. A negative Tail selects the default.
+type LogsRequest struct {
+	Tail     int
+	Since    string
+	Severity string
+}
+
+type LogEntry struct {
+	Time            string `json:"time"`
+	Severity        string `json:"severity,omitempty"`
+	Message         string `json:"message"`
+	Detail          string `json:"detail,omitempty"`
+	Hint            string `json:"hint,omitempty"`
+	Context         string `json:"context,omitempty"`
+	Statement       string `json:"statement,omitempty"`
+	SQLState        string `json:"sql_state,omitempty"`
+	User            string `json:"user,omitempty"`
+	Database        string `json:"database,omitempty"`
+	PID             int    `json:"pid,omitempty"`
+	ApplicationName string `json:"application_name,omitempty"`
+}
+
+type LogsResponse struct {
+	Name   string     `json:"name"`
+	Source string     `json:"source"`
+	Items  []LogEntry `json:"items"`
+}
+
+// WebhookAttempt is one try at delivering an event to a webhook.
+type WebhookAttempt struct {
+	DeliveryID string `json:"delivery_id"`
+	EventID    int64  `json:"event_id"`
+	EventType  string `json:"event_type"`
+	Attempt    int    `json:"attempt"`
+	Time       string `json:"time"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	// Outcome is "delivered", "retrying" or "failed".
+	Outcome string `json:"outcome"`
+}
+
+type WebhookInfo struct {
+	Name    string   `json:"name"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Pending int      `json:"pending"`
+}
+
+type WebhooksResponse struct {
+	Items []WebhookInfo `json:"items"`
+}
+
+type WebhookDeliveriesResponse struct {
+	Name    string           `json:"name"`
+	Pending int              `json:"pending"`
+	Items   []WebhookAttempt `json:"items"`
+}
+
+// ErrorResponse is the body of every failed API call. Code is stable and
+// meant for programs; Message is for people.
+type ErrorResponse struct {
+	Code      string         `json:"code"`
+	Message   string         `json:"message"`
+	Details   map[string]any `json:"details"`
+	RequestID string         `json:"request_id"`
 }
@@ -1,14 +1,32 @@
 package registry
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"syscall"
+	"time"
+
+	"pgdb/daemon/internal/metrics"
+	"pgdb/daemon/internal/tracing"
 )
 
 type UnlockFn func() error
 
-func AcquireLock(lockPath string) (UnlockFn, error) {
+// AcquireLock takes the registry lock, waiting behind other holders until
+// ctx is done. If ctx carries a span the wait is recorded as a child span,
+// so time spent queued behind other operations is visible in the trace.
+func AcquireLock(ctx context.Context, lockPath string) (UnlockFn, error) {
+	if tracing.FromContext(ctx) != nil {
+		_, span := tracing.Start(ctx, "registry lock", "lock.path", lockPath)
+		unlock, err := acquireLock(ctx, lockPath)
+		span.End(err)
+		return unlock, err
+	}
+	return acquireLock(ctx, lockPath)
+}
+
+func acquireLock(ctx context.Context, lockPath string) (UnlockFn, error) {
 	if err := os.MkdirAll(parentDir(lockPath), 0o755); err != nil {
 		return nil, fmt.Errorf("create lock directory: %w", err)
 	}
@@ -18,12 +36,7 @@ func AcquireLock(lockPath string) (UnlockFn, error) {
 		return nil, fmt.Errorf("open lock file: %w", err)
 	}
 
-	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
-		_ = f.Close()
-		return nil, fmt.Errorf("acquire lock: %w", err)
-	}
-
-	return func() error {
+	unlock := func() error {
 		unlockErr := syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
 		closeErr := f.Close()
 		if unlockErr != nil {
@@ -33,7 +46,39 @@ func AcquireLock(lockPath string) (UnlockFn, error) {
 			return fmt.Errorf("close lock file: %w", closeErr)
 		}
 		return nil
-	}, nil
+	}
+
+	// flock cannot be interrupted, so wait for it on a goroutine. If ctx
+	// ends first, that goroutine releases the lock as soon as it gets it.
+	start := time.Now()
+	acquired := make(chan error)
+	abandoned := make(chan struct{})
+	go func() {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		select {
+		case acquired <- err:
+		case <-abandoned:
+			if err == nil {
+				_ = unlock()
+			} else {
+				_ = f.Close()
+			}
+		}
+	}()
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("acquire lock: %w", err)
+		}
+	case <-ctx.Done():
+		close(abandoned)
+		return nil, fmt.Errorf("acquire lock: %w", ctx.Err())
+	}
+	metrics.LockWait.Observe(time.Since(start).Seconds())
+
+	return unlock, nil
 }
 
 func parentDir(path string) string {
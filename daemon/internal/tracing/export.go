@@ -0,0 +1,217 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JSONExporter writes each span as one JSON line, for reading traces
+// without a collector.
+type JSONExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+func (e *JSONExporter) ExportSpans(spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range spans {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if _, err := e.w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector using OTLP over
+// HTTP with JSON encoding.
+type OTLPExporter struct {
+	// URL is the full traces URL, e.g. http://localhost:4318/v1/traces.
+	URL         string
+	Headers     map[string]string
+	ServiceName string
+	Client      *http.Client
+}
+
+func (e *OTLPExporter) ExportSpans(spans []SpanData) error {
+	body, err := json.Marshal(otlpRequest(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("export spans: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("export spans: collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in the OTLP JSON
+// encoding: IDs in hex, 64-bit integers as strings.
+func otlpRequest(serviceName string, spans []SpanData) map[string]any {
+	out := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]any{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"name":              s.Name,
+			"kind":              int(s.Kind),
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+		}
+		if s.ParentID != "" {
+			span["parentSpanId"] = s.ParentID
+		}
+		if s.Error != "" {
+			span["status"] = map[string]any{"code": 2, "message": s.Error}
+		}
+		if len(s.Events) > 0 {
+			events := make([]map[string]any, 0, len(s.Events))
+			for _, e := range s.Events {
+				events = append(events, map[string]any{
+					"name":         e.Name,
+					"timeUnixNano": strconv.FormatInt(e.Time.UnixNano(), 10),
+					"attributes":   otlpAttributes(e.Attributes),
+				})
+			}
+			span["events"] = events
+		}
+		out = append(out, span)
+	}
+	return map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": serviceName}),
+			},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": "pgdbd"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]any) []map[string]any {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]map[string]any, 0, len(attrs))
+	for _, k := range keys {
+		var value map[string]any
+		switch v := attrs[k].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]any{"key": k, "value": value})
+	}
+	return out
+}
+
+const (
+	batchQueueSize = 2048
+	batchMaxSpans  = 512
+)
+
+// Batcher queues spans and exports them in batches from Run, so a slow
+// or unreachable collector never delays requests. Spans that do not fit
+// in the queue are dropped.
+type Batcher struct {
+	Exporter Exporter
+	Logger   *slog.Logger
+
+	mu      sync.Mutex
+	queue   []SpanData
+	dropped int
+}
+
+func (b *Batcher) ExportSpans(spans []SpanData) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range spans {
+		if len(b.queue) >= batchQueueSize {
+			b.dropped++
+			continue
+		}
+		b.queue = append(b.queue, s)
+	}
+	return nil
+}
+
+// Run exports the queued spans at every tick. Once ctx is done it exports
+// what is still queued and returns, so spans are not lost on shutdown.
+func (b *Batcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			b.flush()
+			return
+		case <-ticker.C:
+			b.flush()
+		}
+	}
+}
+
+func (b *Batcher) flush() {
+	b.mu.Lock()
+	queue, dropped := b.queue, b.dropped
+	b.queue, b.dropped = nil, 0
+	b.mu.Unlock()
+
+	if dropped > 0 {
+		b.Logger.Warn("trace export queue full, spans dropped", "dropped", dropped)
+	}
+	for len(queue) > 0 {
+		n := min(len(queue), batchMaxSpans)
+		if err := b.Exporter.ExportSpans(queue[:n]); err != nil {
+			b.Logger.Warn("trace export failed", "spans", len(queue), "error", err)
+			return
+		}
+		queue = queue[n:]
+	}
+}
@@ -0,0 +1,197 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capture keeps exported spans in memory.
+type capture struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (c *capture) ExportSpans(spans []SpanData) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spans = append(c.spans, spans...)
+	return nil
+}
+
+func (c *capture) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.spans)
+}
+
+// otlpSpan is the subset of the OTLP JSON span the daemon sends.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Events            []struct {
+		Name         string          `json:"name"`
+		TimeUnixNano string          `json:"timeUnixNano"`
+		Attributes   []otlpAttribute `json:"attributes"`
+	} `json:"events"`
+	Status *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpBody struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+var (
+	traceIDRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	spanIDRe  = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+func attribute(attrs []otlpAttribute, key string) map[string]any {
+	for _, a := range attrs {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+func TestOTLPExporterEncoding(t *testing.T) {
+	spans := &capture{}
+	SetExporter(spans)
+	defer SetExporter(nil)
+
+	ctx, parent := StartServer(context.Background(), "POST /v1/databases", "", "http.status_code", 500)
+	_, child := Start(ctx, "docker run", "docker.container", "pgdb-app", "retry", true)
+	child.AddEvent("not ready", "attempt", int64(3))
+	child.End(errors.New("container exited"))
+	parent.End(nil)
+	if spans.len() != 2 {
+		t.Fatalf("exported %d spans, want 2", spans.len())
+	}
+
+	var body otlpBody
+	var contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	e := &OTLPExporter{URL: srv.URL, ServiceName: "pgdbd-test", Client: srv.Client()}
+	if err := e.ExportSpans(spans.spans); err != nil {
+		t.Fatalf("ExportSpans: %v", err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("content type: got %q", contentType)
+	}
+
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("want one resource and scope, got %+v", body)
+	}
+	if got := attribute(body.ResourceSpans[0].Resource.Attributes, "service.name"); got["stringValue"] != "pgdbd-test" {
+		t.Errorf("service.name: got %v", got)
+	}
+	got := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(got) != 2 {
+		t.Fatalf("got %d spans, want 2", len(got))
+	}
+	c, p := got[0], got[1]
+
+	for _, s := range got {
+		if !traceIDRe.MatchString(s.TraceID) || !spanIDRe.MatchString(s.SpanID) {
+			t.Errorf("%s: IDs not hex: trace %q, span %q", s.Name, s.TraceID, s.SpanID)
+		}
+		start, err := strconv.ParseInt(s.StartTimeUnixNano, 10, 64)
+		if err != nil {
+			t.Errorf("%s: startTimeUnixNano %q is not a decimal string", s.Name, s.StartTimeUnixNano)
+		}
+		end, err := strconv.ParseInt(s.EndTimeUnixNano, 10, 64)
+		if err != nil || end < start {
+			t.Errorf("%s: endTimeUnixNano %q is not a decimal string after the start", s.Name, s.EndTimeUnixNano)
+		}
+	}
+	if c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID || p.ParentSpanID != "" {
+		t.Errorf("parent links: child %s/%s, parent %s/%s", c.TraceID, c.ParentSpanID, p.TraceID, p.SpanID)
+	}
+	if p.Kind != int(KindServer) || c.Kind != int(KindInternal) {
+		t.Errorf("kinds: parent %d, child %d", p.Kind, c.Kind)
+	}
+
+	if c.Status == nil || c.Status.Code != 2 || c.Status.Message != "container exited" {
+		t.Errorf("failed span status: got %+v, want code 2 with the error", c.Status)
+	}
+	if p.Status != nil {
+		t.Errorf("successful span status: got %+v, want none", p.Status)
+	}
+
+	if v := attribute(p.Attributes, "http.status_code"); v["intValue"] != "500" {
+		t.Errorf("int attribute: got %v, want string intValue", v)
+	}
+	if v := attribute(c.Attributes, "retry"); v["boolValue"] != true {
+		t.Errorf("bool attribute: got %v", v)
+	}
+	if v := attribute(c.Attributes, "docker.container"); v["stringValue"] != "pgdb-app" {
+		t.Errorf("string attribute: got %v", v)
+	}
+
+	if len(c.Events) != 1 || c.Events[0].Name != "not ready" {
+		t.Fatalf("events: got %+v", c.Events)
+	}
+	if _, err := strconv.ParseInt(c.Events[0].TimeUnixNano, 10, 64); err != nil {
+		t.Errorf("event timeUnixNano %q is not a decimal string", c.Events[0].TimeUnixNano)
+	}
+	if v := attribute(c.Events[0].Attributes, "attempt"); v["intValue"] != "3" {
+		t.Errorf("event attribute: got %v", v)
+	}
+}
+
+func TestBatcherFlushesOnShutdown(t *testing.T) {
+	spans := &capture{}
+	b := &Batcher{Exporter: spans, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	_ = b.ExportSpans([]SpanData{{Name: "a"}, {Name: "b"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Run(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	if n := spans.len(); n != 2 {
+		t.Fatalf("exported %d spans on shutdown, want 2", n)
+	}
+}
@@ -0,0 +1,228 @@
+// Package tracing records spans in the OpenTelemetry data model and hands
+// them to an exporter (see export.go). It implements the small part of
+// OpenTelemetry the daemon needs: nested spans with attributes and events,
+// W3C trace context propagation and OTLP export.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+)
+
+// SpanData is an ended span as exporters see it.
+type SpanData struct {
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_span_id,omitempty"`
+	Name       string         `json:"name"`
+	Kind       Kind           `json:"kind"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	DurationMS float64        `json:"duration_ms"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Events     []Event        `json:"events,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type Event struct {
+	Name       string         `json:"name"`
+	Time       time.Time      `json:"time"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+}
+
+// Exporter receives ended spans. It is called on the goroutine that ends
+// the span, so slow exporters should queue (see Batcher).
+type Exporter interface {
+	ExportSpans(spans []SpanData) error
+}
+
+var exporter atomic.Value // holds exporterBox
+
+type exporterBox struct{ Exporter }
+
+// SetExporter sends all spans ended from now on to e. Without an exporter
+// spans are still created, so trace IDs show up in logs, but are dropped.
+func SetExporter(e Exporter) {
+	exporter.Store(exporterBox{e})
+}
+
+// Span is an operation in progress. All methods are safe on a nil *Span,
+// so callers need not check whether tracing applies.
+type Span struct {
+	mu      sync.Mutex
+	data    SpanData
+	sampled bool
+	ended   bool
+}
+
+type spanKey struct{}
+
+// FromContext returns the span in ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start begins a span named name as a child of the span in ctx, or as the
+// root of a new trace. attrs are key/value pairs.
+func Start(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	s := &Span{data: SpanData{Name: name, Kind: KindInternal, Start: time.Now(), SpanID: newID(8)}, sampled: true}
+	if parent := FromContext(ctx); parent != nil {
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentID = parent.data.SpanID
+		s.sampled = parent.sampled
+	} else {
+		s.data.TraceID = newID(16)
+	}
+	s.setAttrs(attrs)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// StartServer begins the span of an incoming request. A valid W3C
+// traceparent header makes it part of the caller's trace, and the caller's
+// sampling decision is kept.
+func StartServer(ctx context.Context, name, traceparent string, attrs ...any) (context.Context, *Span) {
+	ctx, s := Start(ctx, name, attrs...)
+	s.data.Kind = KindServer
+	if traceID, spanID, sampled, ok := ParseTraceparent(traceparent); ok {
+		s.data.TraceID = traceID
+		s.data.ParentID = spanID
+		s.sampled = sampled
+	}
+	return ctx, s
+}
+
+// ParseTraceparent parses a version 00 W3C traceparent header.
+func ParseTraceparent(header string) (traceID, spanID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || !isHexID(parts[1], 16) || !isHexID(parts[2], 8) || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return "", "", false, false
+	}
+	return parts[1], parts[2], flags[0]&1 == 1, true
+}
+
+func isHexID(s string, size int) bool {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != size || strings.ToLower(s) != s {
+		return false
+	}
+	for _, c := range b {
+		if c != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func newID(size int) string {
+	b := make([]byte, size)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// TraceID returns the span's trace ID, or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.data.TraceID
+}
+
+// Traceparent returns the W3C traceparent header naming this span.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + s.data.TraceID + "-" + s.data.SpanID + "-" + flags
+}
+
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.setAttrs([]any{key, value})
+	}
+}
+
+func (s *Span) setAttrs(attrs []any) {
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if s.data.Attributes == nil {
+			s.data.Attributes = map[string]any{}
+		}
+		s.data.Attributes[fmt.Sprint(attrs[i])] = attrs[i+1]
+	}
+}
+
+// AddEvent records a point in time within the span.
+func (s *Span) AddEvent(name string, attrs ...any) {
+	if s == nil {
+		return
+	}
+	e := Event{Name: name, Time: time.Now()}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if e.Attributes == nil {
+			e.Attributes = map[string]any{}
+		}
+		e.Attributes[fmt.Sprint(attrs[i])] = attrs[i+1]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.data.Events = append(s.data.Events, e)
+	}
+}
+
+// End finishes the span, marking it failed when err is not nil, and
+// exports it. Only the first call has an effect.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	s.data.DurationMS = float64(s.data.End.Sub(s.data.Start).Microseconds()) / 1000
+	if err != nil {
+		s.data.Error = err.Error()
+	}
+	data := s.data
+	s.mu.Unlock()
+
+	box, _ := exporter.Load().(exporterBox)
+	if !s.sampled || box.Exporter == nil {
+		return
+	}
+	_ = box.ExportSpans([]SpanData{data})
+}
@@ -0,0 +1,375 @@
+// Package webhooks delivers lifecycle events to the HTTP endpoints
+// configured under "webhooks". Deliveries wait in a queue persisted next to
+// the registry and are retried with exponential backoff, so events are not
+// lost when a receiver or the daemon is down.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"pgdb/daemon/internal/config"
+	"pgdb/daemon/internal/events"
+	"pgdb/daemon/internal/model"
+	"pgdb/daemon/internal/util"
+)
+
+const (
+	maxAttempts    = 8
+	initialBackoff = 10 * time.Second
+	maxBackoff     = time.Hour
+	requestTimeout = 10 * time.Second
+	// recentAttempts is how many attempts are kept per webhook.
+	recentAttempts = 50
+)
+
+type delivery struct {
+	ID          string       `json:"id"`
+	Webhook     string       `json:"webhook"`
+	Event       events.Event `json:"event"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt_at"`
+}
+
+type state struct {
+	LastEventID int64                             `json:"last_event_id"`
+	Queue       []delivery                        `json:"queue"`
+	Recent      map[string][]model.WebhookAttempt `json:"recent"`
+}
+
+type Dispatcher struct {
+	StatePath string
+	Webhooks  []config.Webhook
+	Events    *events.Log
+	Logger    *slog.Logger
+	Client    *http.Client
+
+	mu    sync.Mutex
+	state state
+}
+
+// Load reads the persisted queue. On the first start the dispatcher begins
+// after the newest event rather than delivering the whole event log.
+func (d *Dispatcher) Load() error {
+	d.state = state{LastEventID: -1, Recent: map[string][]model.WebhookAttempt{}}
+	b, err := os.ReadFile(d.StatePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read webhook state: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &d.state); err != nil {
+			return fmt.Errorf("parse webhook state: %w", err)
+		}
+		if d.state.Recent == nil {
+			d.state.Recent = map[string][]model.WebhookAttempt{}
+		}
+	}
+	if d.state.LastEventID < 0 {
+		d.state.LastEventID = d.Events.LastID()
+	}
+
+	// Drop deliveries for webhooks that were removed from the config.
+	queue := d.state.Queue[:0]
+	for _, dl := range d.state.Queue {
+		if _, ok := d.webhook(dl.Webhook); ok {
+			queue = append(queue, dl)
+		}
+	}
+	d.state.Queue = queue
+	return nil
+}
+
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.enqueue()
+			d.deliverDue(ctx, time.Now())
+		}
+	}
+}
+
+// enqueue queues the events published since the last pass for every
+// webhook that subscribes to them.
+func (d *Dispatcher) enqueue() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	newEvents := d.Events.Since(d.state.LastEventID)
+	if len(newEvents) == 0 {
+		return
+	}
+	for _, e := range newEvents {
+		for _, w := range d.Webhooks {
+			if !w.Wants(e.Type) {
+				continue
+			}
+			id, err := util.RandomLowerAlphaNum(16)
+			if err != nil {
+				d.Logger.Error("webhook: delivery id failed", "error", err)
+				continue
+			}
+			d.state.Queue = append(d.state.Queue, delivery{ID: id, Webhook: w.Name, Event: e, NextAttempt: time.Now()})
+		}
+		d.state.LastEventID = e.ID
+	}
+	d.save()
+}
+
+// deliverDue sends the deliveries that are due. Webhooks are served
+// concurrently, each in queue order, and a webhook's pass ends at its first
+// failure, so a dead receiver with a backlog costs one request timeout per
+// pass and does not hold up the others.
+func (d *Dispatcher) deliverDue(ctx context.Context, now time.Time) {
+	d.mu.Lock()
+	due := map[string][]delivery{}
+	for _, dl := range d.state.Queue {
+		if !dl.NextAttempt.After(now) {
+			due[dl.Webhook] = append(due[dl.Webhook], dl)
+		}
+	}
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for name, deliveries := range due {
+		w, ok := d.webhook(name)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(w config.Webhook, deliveries []delivery) {
+			defer wg.Done()
+			for _, dl := range deliveries {
+				if ctx.Err() != nil || !d.deliver(w, dl) {
+					return
+				}
+			}
+		}(w, deliveries)
+	}
+	wg.Wait()
+}
+
+// deliver makes one attempt at dl and updates the queue. It reports
+// whether the attempt succeeded.
+func (d *Dispatcher) deliver(w config.Webhook, dl delivery) bool {
+	dl.Attempts++
+	attempt := d.send(w, dl)
+	switch {
+	case attempt.Error == "":
+		attempt.Outcome = "delivered"
+	case dl.Attempts >= maxAttempts:
+		attempt.Outcome = "failed"
+		d.Logger.Error("webhook delivery failed", "webhook", w.Name, "event_id", dl.Event.ID, "attempts", dl.Attempts, "error", attempt.Error)
+	default:
+		attempt.Outcome = "retrying"
+		dl.NextAttempt = time.Now().Add(backoff(dl.Attempts))
+	}
+
+	d.mu.Lock()
+	d.record(w.Name, attempt)
+	for i := range d.state.Queue {
+		if d.state.Queue[i].ID != dl.ID {
+			continue
+		}
+		if attempt.Outcome == "retrying" {
+			d.state.Queue[i] = dl
+		} else {
+			d.state.Queue = append(d.state.Queue[:i], d.state.Queue[i+1:]...)
+		}
+		break
+	}
+	d.save()
+	d.mu.Unlock()
+	return attempt.Outcome == "delivered"
+}
+
+// Test sends a webhook.test event to the named webhook once, without
+// retries, and returns the attempt.
+func (d *Dispatcher) Test(name string) (model.WebhookAttempt, error) {
+	w, ok := d.webhook(name)
+	if !ok {
+		return model.WebhookAttempt{}, fmt.Errorf("webhook '%s' not found", name)
+	}
+	id, err := util.RandomLowerAlphaNum(16)
+	if err != nil {
+		return model.WebhookAttempt{}, err
+	}
+
+	dl := delivery{
+		ID:       id,
+		Webhook:  name,
+		Event:    events.Event{Type: events.WebhookTest, Time: util.NowRFC3339()},
+		Attempts: 1,
+	}
+	attempt := d.send(w, dl)
+	attempt.Outcome = "delivered"
+	if attempt.Error != "" {
+		attempt.Outcome = "failed"
+	}
+
+	d.mu.Lock()
+	d.record(name, attempt)
+	d.save()
+	d.mu.Unlock()
+	return attempt, nil
+}
+
+func (d *Dispatcher) List() model.WebhooksResponse {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	items := make([]model.WebhookInfo, 0, len(d.Webhooks))
+	for _, w := range d.Webhooks {
+		subscribed := w.Events
+		if len(subscribed) == 0 {
+			subscribed = events.Types
+		}
+		items = append(items, model.WebhookInfo{Name: w.Name, URL: w.URL, Events: subscribed, Pending: d.pending(w.Name)})
+	}
+	return model.WebhooksResponse{Items: items}
+}
+
+// Deliveries returns the latest attempts for the named webhook, newest
+// first.
+func (d *Dispatcher) Deliveries(name string) (model.WebhookDeliveriesResponse, error) {
+	if _, ok := d.webhook(name); !ok {
+		return model.WebhookDeliveriesResponse{}, fmt.Errorf("webhook '%s' not found", name)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	recent := d.state.Recent[name]
+	items := make([]model.WebhookAttempt, 0, len(recent))
+	for i := len(recent) - 1; i >= 0; i-- {
+		items = append(items, recent[i])
+	}
+	return model.WebhookDeliveriesResponse{Name: name, Pending: d.pending(name), Items: items}, nil
+}
+
+// send posts the event and reports the attempt. The signature covers the
+// timestamp and the body, so receivers can reject replayed requests.
+func (d *Dispatcher) send(w config.Webhook, dl delivery) model.WebhookAttempt {
+	attempt := model.WebhookAttempt{
+		DeliveryID: dl.ID,
+		EventID:    dl.Event.ID,
+		EventType:  dl.Event.Type,
+		Attempt:    dl.Attempts,
+		Time:       util.NowRFC3339(),
+	}
+
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pgdbd-webhooks")
+	req.Header.Set("X-Pgdb-Event", dl.Event.Type)
+	req.Header.Set("X-Pgdb-Delivery", dl.ID)
+	req.Header.Set("X-Pgdb-Timestamp", timestamp)
+	req.Header.Set("X-Pgdb-Signature", "sha256="+Sign(w.Secret, timestamp, body))
+
+	start := time.Now()
+	resp, err := d.Client.Do(req)
+	attempt.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = "unexpected status " + resp.Status
+	}
+	return attempt
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" under secret.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func backoff(attempts int) time.Duration {
+	wait := initialBackoff << (attempts - 1)
+	if wait > maxBackoff || wait <= 0 {
+		return maxBackoff
+	}
+	return wait
+}
+
+func (d *Dispatcher) webhook(name string) (config.Webhook, bool) {
+	for _, w := range d.Webhooks {
+		if w.Name == name {
+			return w, true
+		}
+	}
+	return config.Webhook{}, false
+}
+
+func (d *Dispatcher) pending(name string) int {
+	n := 0
+	for _, dl := range d.state.Queue {
+		if dl.Webhook == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *Dispatcher) record(name string, attempt model.WebhookAttempt) {
+	recent := append(d.state.Recent[name], attempt)
+	if len(recent) > recentAttempts {
+		recent = recent[len(recent)-recentAttempts:]
+	}
+	d.state.Recent[name] = recent
+}
+
+// save writes the state atomically; failures are logged and retried on
+// the next change.
+func (d *Dispatcher) save() {
+	b, err := json.MarshalIndent(d.state, "", "  ")
+	if err != nil {
+		d.Logger.Error("webhook: marshal state failed", "error", err)
+		return
+	}
+	tmp := d.StatePath + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		d.Logger.Error("webhook: write state failed", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, d.StatePath); err != nil {
+		d.Logger.Error("webhook: replace state failed", "error", err)
+	}
+}
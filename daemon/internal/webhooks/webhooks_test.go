@@ -0,0 +1,147 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"pgdb/daemon/internal/config"
+	"pgdb/daemon/internal/events"
+)
+
+type received struct {
+	event     string
+	delivery  string
+	signature string
+	timestamp string
+	body      []byte
+}
+
+// receiver answers the given status codes in turn, then 200, and records
+// every request.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []received
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, received{
+		event:     r.Header.Get("X-Pgdb-Event"),
+		delivery:  r.Header.Get("X-Pgdb-Delivery"),
+		signature: r.Header.Get("X-Pgdb-Signature"),
+		timestamp: r.Header.Get("X-Pgdb-Timestamp"),
+		body:      body,
+	})
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func newDispatcher(t *testing.T, dir string, log *events.Log, url string) *Dispatcher {
+	t.Helper()
+	d := &Dispatcher{
+		StatePath: filepath.Join(dir, "webhooks.json"),
+		Webhooks:  []config.Webhook{{Name: "ci", URL: url, Secret: "s3cret"}},
+		Events:    log,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Client:    &http.Client{},
+	}
+	if err := d.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return d
+}
+
+func TestDeliveryRetriesWithBackoffAndSurvivesRestart(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusInternalServerError}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	log, err := events.Open(filepath.Join(dir, "events.jsonl"), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("open event log: %v", err)
+	}
+	d := newDispatcher(t, dir, log, srv.URL)
+
+	log.Publish(events.Destroyed, "app", nil)
+	d.enqueue()
+	start := time.Now()
+	d.deliverDue(context.Background(), start)
+
+	d.mu.Lock()
+	if len(d.state.Queue) != 1 {
+		d.mu.Unlock()
+		t.Fatalf("queue after failed attempt: got %d deliveries, want 1", len(d.state.Queue))
+	}
+	dl := d.state.Queue[0]
+	d.mu.Unlock()
+	if dl.Attempts != 1 {
+		t.Errorf("attempts: got %d, want 1", dl.Attempts)
+	}
+	if wait := dl.NextAttempt.Sub(start); wait < initialBackoff || wait > initialBackoff+5*time.Second {
+		t.Errorf("next attempt in %s, want about %s", wait, initialBackoff)
+	}
+
+	// Not due yet: nothing is sent.
+	d.deliverDue(context.Background(), start.Add(initialBackoff/2))
+	if n := len(rc.requests); n != 1 {
+		t.Fatalf("requests before backoff elapsed: got %d, want 1", n)
+	}
+
+	// The queue is persisted, so a restarted dispatcher retries it.
+	d = newDispatcher(t, dir, log, srv.URL)
+	d.deliverDue(context.Background(), start.Add(initialBackoff+5*time.Second))
+
+	if n := len(rc.requests); n != 2 {
+		t.Fatalf("requests: got %d, want 2", n)
+	}
+	first, second := rc.requests[0], rc.requests[1]
+	if first.delivery != second.delivery || first.event != events.Destroyed {
+		t.Errorf("retry headers: got %+v and %+v", first, second)
+	}
+	for _, req := range rc.requests {
+		if want := "sha256=" + Sign("s3cret", req.timestamp, req.body); req.signature != want {
+			t.Errorf("signature: got %q, want %q", req.signature, want)
+		}
+	}
+
+	resp, err := d.Deliveries("ci")
+	if err != nil {
+		t.Fatalf("Deliveries: %v", err)
+	}
+	if resp.Pending != 0 || len(resp.Items) != 2 {
+		t.Fatalf("deliveries: got pending %d and %d attempts, want 0 and 2", resp.Pending, len(resp.Items))
+	}
+	if got := resp.Items[0]; got.Outcome != "delivered" || got.Attempt != 2 {
+		t.Errorf("latest attempt: got %+v, want delivered on attempt 2", got)
+	}
+	if got := resp.Items[1]; got.Outcome != "retrying" || got.StatusCode != http.StatusInternalServerError {
+		t.Errorf("first attempt: got %+v, want retrying after 500", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  initialBackoff,
+		2:  2 * initialBackoff,
+		4:  8 * initialBackoff,
+		20: maxBackoff,
+	} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
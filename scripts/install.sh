@@ -35,12 +35,18 @@ echo "Preparing directories..."
 mkdir -p /var/lib/pgdb
 chmod 755 /var/lib/pgdb
 
+if [[ ! -f /etc/pgdbd.audit.key ]]; then
+  echo "Generating /etc/pgdbd.audit.key..."
+  (umask 077 && head -c 32 /dev/urandom | od -An -tx1 | tr -d ' \n' >/etc/pgdbd.audit.key)
+fi
+
 echo "Writing /etc/pgdbd.env..."
 cat >/etc/pgdbd.env <<EOF
 PGDB_TOKEN=${TOKEN}
 PGDB_LISTEN=${LISTEN}
 PGDB_DATA_DIR=/var/lib/pgdb
 PGDB_PUBLIC_HOST=${PUBLIC_HOST}
+PGDB_AUDIT_KEY_FILE=/etc/pgdbd.audit.key
 EOF
 chmod 600 /etc/pgdbd.env
 